@@ -1,21 +1,43 @@
 package ginprometheus
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	log "github.com/sirupsen/logrus"
 )
 
 var defaultMetricPath = "/metrics"
 
+// DefaultSubsystem is the subsystem used by NewWithConfig when Config.Subsystem is empty
+var DefaultSubsystem = "gin"
+
 // Standard default metrics
 //	counter, counter_vec, gauge, gauge_vec,
 //	histogram, histogram_vec, summary, summary_vec
@@ -53,6 +75,267 @@ var standardMetrics = []*Metric{
 	reqSz,
 }
 
+// Optional metrics, registered depending on the Config
+var reqRateLimited = &Metric{
+	ID:          "reqRateLimited",
+	Name:        "requests_rate_limited_total",
+	Description: "How many HTTP requests were rate limited, partitioned by url.",
+	Type:        "counter_vec",
+	Args:        []string{"url"}}
+
+var reqDurFast = &Metric{
+	ID:          "reqDurFast",
+	Name:        "request_duration_fast_seconds",
+	Description: "The HTTP request latencies in seconds, of requests faster than a second.",
+	Type:        "histogram_vec",
+	Args:        []string{"code", "method", "url"},
+	Buckets:     []float64{.005, .01, .025, .05, .1, .25, .5, 1},
+}
+
+var reqDurSlow = &Metric{
+	ID:          "reqDurSlow",
+	Name:        "request_duration_slow_seconds",
+	Description: "The HTTP request latencies in seconds, of requests of a second or more.",
+	Type:        "histogram_vec",
+	Args:        []string{"code", "method", "url"},
+	Buckets:     []float64{2.5, 5, 10, 30, 60, 120, 300},
+}
+
+var selfOverhead = &Metric{
+	ID:          "selfOverhead",
+	Name:        "instrumentation_overhead_seconds",
+	Description: "The time spent by the middleware recording the metrics of a request, in seconds.",
+	Type:        "summary"}
+
+var scrapeDur = &Metric{
+	ID:          "scrapeDur",
+	Name:        "scrape_duration_seconds",
+	Description: "The time spent gathering and encoding the metrics on a scrape, in seconds.",
+	Type:        "histogram"}
+
+var reqCntLow = &Metric{
+	ID:          "reqCntLow",
+	Name:        "requests_total_low_cardinality",
+	Description: "How many HTTP requests processed, partitioned by status code class and HTTP method.",
+	Type:        "counter_vec",
+	Args:        []string{"code_class", "method"}}
+
+var reqDurRead = &Metric{
+	ID:          "reqDurRead",
+	Name:        "request_read_duration_seconds",
+	Description: "The HTTP request latencies in seconds, of read requests (GET, HEAD, OPTIONS, TRACE).",
+	Type:        "histogram_vec",
+	Args:        []string{"code", "method", "url"},
+}
+
+var reqDurWrite = &Metric{
+	ID:          "reqDurWrite",
+	Name:        "request_write_duration_seconds",
+	Description: "The HTTP request latencies in seconds, of write requests (POST, PUT, PATCH, DELETE, ...).",
+	Type:        "histogram_vec",
+	Args:        []string{"code", "method", "url"},
+}
+
+var reqServed = &Metric{
+	ID:          "reqServed",
+	Name:        "requests_served_total",
+	Description: "How many HTTP requests processed.",
+	Type:        "counter"}
+
+var coldStart = &Metric{
+	ID:          "coldStart",
+	Name:        "cold_start_duration_seconds",
+	Description: "The latency in seconds of the first HTTP request after the process started.",
+	Type:        "gauge"}
+
+var headerCard = &Metric{
+	ID:          "headerCard",
+	Name:        "header_cardinality",
+	Description: "The number of distinct values seen of diagnostic request headers, capped at 10000.",
+	Type:        "gauge_vec",
+	Args:        []string{"header"}}
+
+var renderDur = &Metric{
+	ID:          "renderDur",
+	Name:        "render_duration_seconds",
+	Description: "The time in seconds from the first write of the HTTP response body to the end of the request, partitioned by url.",
+	Type:        "histogram_vec",
+	Args:        []string{"url"}}
+
+var reqDurSummary = &Metric{
+	ID:          "reqDurSummary",
+	Name:        "request_duration_summary_seconds",
+	Description: "The HTTP request latencies in seconds, as quantiles computed by the server.",
+	Type:        "summary_vec",
+	Args:        []string{"code", "method", "url"},
+	Objectives:  map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}}
+
+var reqConcurrency = &Metric{
+	ID:          "reqConcurrency",
+	Name:        "requests_concurrency",
+	Description: "The number of HTTP requests in flight, sampled at the start of each request.",
+	Type:        "histogram",
+	Buckets:     []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}}
+
+var wsUpgrades = &Metric{
+	ID:          "wsUpgrades",
+	Name:        "websocket_upgrades_total",
+	Description: "How many HTTP requests were upgraded to another protocol, e.g. WebSocket, partitioned by url.",
+	Type:        "counter_vec",
+	Args:        []string{"url"}}
+
+var renderErrors = &Metric{
+	ID:          "renderErrors",
+	Name:        "render_errors_total",
+	Description: "How many HTTP responses failed to render, e.g. because the client went away, partitioned by url.",
+	Type:        "counter_vec",
+	Args:        []string{"url"}}
+
+var bodyReadErrors = &Metric{
+	ID:          "bodyReadErrors",
+	Name:        "request_body_read_errors_total",
+	Description: "How many HTTP requests failed to read or close their body, partitioned by url.",
+	Type:        "counter_vec",
+	Args:        []string{"url"}}
+
+var informational = &Metric{
+	ID:          "informational",
+	Name:        "informational_responses_total",
+	Description: "How many informational 1xx responses, other than 101, preceded the final HTTP responses, partitioned by status code.",
+	Type:        "counter_vec",
+	Args:        []string{"code"}}
+
+var retryAfter = &Metric{
+	ID:          "retryAfter",
+	Name:        "retry_after_seconds",
+	Description: "The Retry-After delay in seconds of the HTTP 429 Too Many Requests responses.",
+	Type:        "histogram",
+	Buckets:     []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}}
+
+var metricsDropped = &Metric{
+	ID:          "metricsDropped",
+	Name:        "metrics_dropped_total",
+	Description: "How many HTTP requests weren't recorded because the buffer of the background recorder was full.",
+	Type:        "counter"}
+
+var gatherErrors = &Metric{
+	ID:          "gatherErrors",
+	Name:        "registry_gather_errors_total",
+	Description: "How many periodic self-checks failed to gather the metrics of the registry.",
+	Type:        "counter"}
+
+var maxHeaderSz = &Metric{
+	ID:          "maxHeaderSz",
+	Name:        "max_request_header_bytes",
+	Description: "The size in bytes of the largest header value of the HTTP requests.",
+	Type:        "histogram",
+	Buckets:     []float64{64, 256, 1024, 2048, 4096, 8192, 16384}}
+
+var upstreamDur = &Metric{
+	ID:          "upstreamDur",
+	Name:        "upstream_response_seconds",
+	Description: "The response time in seconds reported by the upstream backends of the HTTP requests.",
+	Type:        "histogram"}
+
+var bodyWriteDur = &Metric{
+	ID:          "bodyWriteDur",
+	Name:        "body_write_duration_seconds",
+	Description: "The time in seconds from the write of the HTTP response header to the end of the request, partitioned by url.",
+	Type:        "histogram_vec",
+	Args:        []string{"url"}}
+
+var budgetExceeded = &Metric{
+	ID:          "budgetExceeded",
+	Name:        "cardinality_budget_exceeded",
+	Description: "1 if more distinct url labels than allowed were seen, new ones being recorded as <over-budget>.",
+	Type:        "gauge"}
+
+var stageDur = &Metric{
+	ID:          "stageDur",
+	Name:        "middleware_stage_duration_seconds",
+	Description: "The time in seconds spent in the stages of the middleware chain wrapped by TimeStage, partitioned by stage.",
+	Type:        "histogram_vec",
+	Args:        []string{"stage"}}
+
+// contextGaugeID is the ID of the gauge of Config.ContextValueGauge
+const contextGaugeID = "contextGauge"
+
+// pushes is registered on the first push to the pushgateways
+var pushes = &Metric{
+	ID:          "pushes",
+	Name:        "pushgateway_pushes_total",
+	Description: "How many times the metrics were pushed, partitioned by pushgateway URL and result.",
+	Type:        "counter_vec",
+	Args:        []string{"gateway", "result"}}
+
+// Metrics of ObserveJob, registered on first use
+var jobDur = &Metric{
+	ID:          "jobDur",
+	Name:        "job_duration_seconds",
+	Description: "The duration in seconds of the runs of background jobs, partitioned by job name.",
+	Type:        "histogram_vec",
+	Args:        []string{"name"}}
+
+var jobRuns = &Metric{
+	ID:          "jobRuns",
+	Name:        "job_runs_total",
+	Description: "How many times background jobs ran, partitioned by job name and result.",
+	Type:        "counter_vec",
+	Args:        []string{"name", "result"}}
+
+// maxContentTypes caps the distinct values of the request_content_type label
+const maxContentTypes = 32
+
+// maxRawPaths caps the distinct values of the path label of Config.DualURLLabels
+const maxRawPaths = 100
+
+// maxHeaderCardinality caps the distinct values tracked per diagnostic header
+const maxHeaderCardinality = 10000
+
+// splitDurationThreshold routes durations between reqDurFast and reqDurSlow, in seconds
+const splitDurationThreshold = 1.0
+
+// rateLimitedKey is the gin.Context key set by MarkRateLimited
+const rateLimitedKey = "ginprometheus.rate_limited"
+
+// mountKey is the gin.Context key set by UseOnGroupWithLabel
+const mountKey = "ginprometheus.mount"
+
+// PathSource selects which path of a request is used by the middleware
+type PathSource int
+
+const (
+	// URLPath uses the path of the request URL
+	URLPath PathSource = iota
+	// FullPath uses the template of the matched route, i.e. c.FullPath(), which is empty for
+	// unmatched requests. It is not affected by rewrites of an outer router embedding the engine
+	FullPath
+)
+
+func (s PathSource) String() string {
+	if s == FullPath {
+		return "full_path"
+	}
+	return "url_path"
+}
+
+// ExpositionFormat selects the format the metrics are exposed in
+type ExpositionFormat int
+
+const (
+	// NegotiateFormat negotiates the format with the Accept header of the scrape
+	NegotiateFormat ExpositionFormat = iota
+	// ProtobufFormat always exposes the metrics in the delimited protobuf format
+	ProtobufFormat
+)
+
+func (f ExpositionFormat) String() string {
+	if f == ProtobufFormat {
+		return "protobuf"
+	}
+	return "negotiate"
+}
+
 /*
 RequestCounterURLLabelMappingFn is a function which can be supplied to the middleware to control
 the cardinality of the request counter's "url" label, which might be required in some contexts.
@@ -74,6 +357,69 @@ which would map "/customer/alice" and "/customer/bob" to their template "/custom
 */
 type RequestCounterURLLabelMappingFn func(c *gin.Context) string
 
+// DropPolicy selects what happens to a request to record when the buffer of the background
+// recorder is full
+type DropPolicy int
+
+const (
+	// DropNewest drops the request
+	DropNewest DropPolicy = iota
+	// DropOldest drops the oldest buffered request to make room for the request
+	DropOldest
+	// Block waits for room in the buffer, delaying the request
+	Block
+)
+
+func (d DropPolicy) String() string {
+	switch d {
+	case DropOldest:
+		return "drop_oldest"
+	case Block:
+		return "block"
+	default:
+		return "drop_newest"
+	}
+}
+
+// ContextValueGauge sets the gauge MetricName to the numeric value stored under Key in the
+// gin.Context by the handlers, e.g. to debug what middleware stashes in the context. Requests
+// without a numeric value under Key leave the gauge unchanged
+type ContextValueGauge struct {
+	Key        string
+	MetricName string
+}
+
+// ExemplarFromContextFn returns the exemplar labels of a request, e.g. its trace id, or nil
+type ExemplarFromContextFn func(c *gin.Context) prometheus.Labels
+
+// TraceparentExemplar is an ExemplarFromContextFn returning the trace id of the W3C traceparent
+// header of the request as a trace_id label, or nil if the header is missing or malformed
+func TraceparentExemplar(c *gin.Context) prometheus.Labels {
+	// version-traceid-parentid-flags, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	parts := strings.Split(c.GetHeader("traceparent"), "-")
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) || parts[0] == "ff" {
+		return nil
+	}
+	for i, size := range []int{2, 32, 16, 2} {
+		if len(parts[i]) != size || !isLowerHex(parts[i]) {
+			return nil
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": parts[1]}
+}
+
+func isLowerHex(s string) bool {
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 // Metric is a definition for the name, description, type, ID, and
 // prometheus.Collector type (i.e. CounterVec, Summary, etc) of each metric
 type Metric struct {
@@ -83,16 +429,79 @@ type Metric struct {
 	Description     string
 	Type            string
 	Args            []string
+	// Buckets of histogram types, defaults to prometheus.DefBuckets
+	Buckets []float64
+	// Objectives of summary types, quantiles to their absolute error. Defaults to no quantiles
+	Objectives map[float64]float64
+	// MaxAge of the observations of summary types, defaults to prometheus.DefMaxAge
+	MaxAge time.Duration
+	// ConstLabels are labels with constant values added to every series of the metric
+	ConstLabels prometheus.Labels
+
+	// adopted is set when MetricCollector was registered by someone else and adopted with
+	// Config.ReuseExistingCollectors, so it must never be unregistered
+	adopted bool
+}
+
+// Errors of the validation of a Metric
+var (
+	ErrEmptyMetricName   = errors.New("empty metric name")
+	ErrInvalidMetricName = errors.New("invalid metric name")
+	ErrUnknownMetricType = errors.New("unknown metric type")
+)
+
+// metricTypes are the valid values of Metric.Type
+var metricTypes = map[string]bool{
+	"counter": true, "counter_vec": true, "gauge": true, "gauge_vec": true,
+	"histogram": true, "histogram_vec": true, "summary": true, "summary_vec": true,
+}
+
+// validate checks the name and type of the metric
+func (m *Metric) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("metric %q: %w", m.ID, ErrEmptyMetricName)
+	}
+	for i, r := range m.Name {
+		if !(r == '_' || r == ':' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return fmt.Errorf("metric %q: %w %q, it must match [a-zA-Z_:][a-zA-Z0-9_:]*", m.ID, ErrInvalidMetricName, m.Name)
+		}
+	}
+	if !metricTypes[m.Type] {
+		return fmt.Errorf("metric %q: %w %q", m.ID, ErrUnknownMetricType, m.Type)
+	}
+	return nil
 }
 
 // Prometheus contains the metrics gathered by the instance and its path
 type Prometheus struct {
-	reqCnt        *prometheus.CounterVec
-	reqDur        *prometheus.HistogramVec
-	reqSz, resSz  prometheus.Summary
-	router        *gin.Engine
-	listenAddress string
-	Ppg           PrometheusPushGateway
+	metrics         *metricSet
+	router          *gin.Engine
+	engine          *gin.Engine
+	listenAddress   string
+	server          *http.Server
+	serverErrs      chan error
+	recordings      chan func()
+	recorderDone    chan struct{}
+	runtimeMetrics  []*Metric
+	configInfo      prometheus.Collector
+	subsystem       string
+	config          Config
+	snapshotStop    chan struct{}
+	clampOnce       sync.Once
+	reconfigMu      sync.RWMutex
+	pushStop        chan struct{}
+	logStop         chan struct{}
+	selfCheckStop   chan struct{}
+	metricsMu       sync.Mutex
+	urlMappingsMu   sync.RWMutex
+	urlMappings     map[string]RequestCounterURLLabelMappingFn
+	routeKeys       []string
+	customLabels    []customLabel
+	customDurLabels []customLabel
+	allowlists      map[string]map[string]bool
+	subsystemSets   map[string]*metricSet
+	subsystemList   []*Metric
+	Ppg             PrometheusPushGateway
 
 	MetricsList []*Metric
 	MetricsPath string
@@ -103,6 +512,50 @@ type Prometheus struct {
 	URLLabelFromContext string
 }
 
+// metricSet contains the collectors of the standard metrics registered in a registry
+type metricSet struct {
+	inFlight       int64 // first for 64-bit alignment of atomic operations
+	cntArgs        []string
+	durArgs        []string
+	reqCnt         *prometheus.CounterVec
+	reqDur         *prometheus.HistogramVec
+	reqDurFast     *prometheus.HistogramVec
+	reqDurSlow     *prometheus.HistogramVec
+	reqDurRead     *prometheus.HistogramVec
+	reqDurWrite    *prometheus.HistogramVec
+	reqDurSummary  *prometheus.SummaryVec
+	reqSz, resSz   prometheus.Observer
+	reqLimited     *prometheus.CounterVec
+	overhead       prometheus.Summary
+	scrapeDur      prometheus.Histogram
+	reqCntLow      *prometheus.CounterVec
+	reqServed      prometheus.Counter
+	coldStart      prometheus.Gauge
+	coldOnce       sync.Once
+	headerCard     *prometheus.GaugeVec
+	headerMu       sync.Mutex
+	headerSeen     map[string]map[uint64]struct{}
+	contentTypes   boundedSet
+	rawPaths       boundedSet
+	urls           boundedSet
+	budgetOnce     sync.Once
+	budgetExceeded prometheus.Gauge
+	contextGauge   prometheus.Gauge
+	stageDur       *prometheus.HistogramVec
+	renderDur      *prometheus.HistogramVec
+	concurrency    prometheus.Histogram
+	wsUpgrades     *prometheus.CounterVec
+	renderErrors   *prometheus.CounterVec
+	bodyReadErrors *prometheus.CounterVec
+	informational  *prometheus.CounterVec
+	retryAfter     prometheus.Histogram
+	dropped        prometheus.Counter
+	gatherErrors   prometheus.Counter
+	upstreamDur    prometheus.Histogram
+	maxHeaderSz    prometheus.Histogram
+	bodyWriteDur   *prometheus.HistogramVec
+}
+
 // PrometheusPushGateway contains the configuration for pushing to a Prometheus pushgateway (optional)
 type PrometheusPushGateway struct {
 
@@ -119,282 +572,3469 @@ type PrometheusPushGateway struct {
 
 	// pushgateway job name, defaults to "gin"
 	Job string
-}
 
-// NewPrometheus generates a new set of metrics with a certain subsystem name
-func NewPrometheus(subsystem string, customMetricsList ...[]*Metric) *Prometheus {
+	// Format of the pushed metrics, expfmt.FmtText (default) or expfmt.FmtProtoDelim which is
+	// more efficient for large metric sets. Metrics are gathered from the registry instead of
+	// MetricsURL when not pushed as text, or if MetricsURL is empty
+	Format expfmt.Format
 
-	var metricsList []*Metric
+	// AdditionalURLs are other pushgateways the metrics are pushed to, e.g. for HA setups. A
+	// failing gateway doesn't prevent pushing to the others
+	AdditionalURLs []string
 
-	if len(customMetricsList) > 1 {
-		panic("Too many args. NewPrometheus( string, <optional []*Metric> ).")
-	} else if len(customMetricsList) == 1 {
-		metricsList = customMetricsList[0]
-	}
+	// Method of the push requests, http.MethodPost (default) which only replaces the pushed
+	// metric families of the group, or http.MethodPut which replaces all the metrics of the group
+	Method string
 
-	for _, metric := range standardMetrics {
-		metricsList = append(metricsList, metric)
-	}
+	// Synchronous doesn't start the background push ticker of SetPushGateway, pushes are made by
+	// the caller with PushNow or PushLoop instead, e.g. in batch jobs or tests
+	Synchronous bool
+}
 
-	p := &Prometheus{
-		MetricsList: metricsList,
-		MetricsPath: defaultMetricPath,
-		ReqCntURLLabelMappingFn: func(c *gin.Context) string {
-			return c.Request.URL.Path // i.e. by default do nothing, i.e. return URL as is
-		},
-	}
+// Config contains the configuration of a Prometheus instance created with NewWithConfig
+type Config struct {
+	// Subsystem is the prometheus subsystem of the metrics, defaults to DefaultSubsystem
+	Subsystem string
 
-	p.registerMetrics(subsystem)
+	// Subsystems are additional subsystems the standard metrics are registered under, one set
+	// per subsystem, e.g. "internal" and "external" for a gateway serving both
+	Subsystems []string
 
-	return p
-}
+	// SubsystemFn classifies the requests into the subsystems of Subsystems, e.g. by a header.
+	// Requests classified into other subsystems are recorded under Subsystem
+	SubsystemFn func(c *gin.Context) string
 
-// SetPushGateway sends metrics to a remote pushgateway exposed on pushGatewayURL
-// every pushIntervalSeconds. Metrics are fetched from metricsURL
-func (p *Prometheus) SetPushGateway(pushGatewayURL, metricsURL string, pushIntervalSeconds time.Duration) {
-	p.Ppg.PushGatewayURL = pushGatewayURL
-	p.Ppg.MetricsURL = metricsURL
-	p.Ppg.PushIntervalSeconds = pushIntervalSeconds
-	p.startPushTicker()
-}
+	// MetricsList contains custom metrics registered alongside the standard ones
+	MetricsList []*Metric
 
-// SetPushGatewayJob job name, defaults to "gin"
-func (p *Prometheus) SetPushGatewayJob(j string) {
-	p.Ppg.Job = j
-}
+	// TrackRateLimited registers a requests_rate_limited_total counter, partitioned by url,
+	// incremented for every request flagged with MarkRateLimited
+	TrackRateLimited bool
 
-// SetListenAddress for exposing metrics on address. If not set, it will be exposed at the
-// same address of the gin engine that is being used
-func (p *Prometheus) SetListenAddress(address string) {
-	p.listenAddress = address
-	if p.listenAddress != "" {
-		p.router = gin.Default()
-	}
-}
+	// ExcludeBodyReadFromDuration subtracts the time spent reading the request body from the
+	// observed request duration, so that slow uploading clients don't inflate server latencies
+	ExcludeBodyReadFromDuration bool
 
-// SetListenAddressWithRouter for using a separate router to expose metrics. (this keeps things like GET /metrics out of
-// your content's access log).
-func (p *Prometheus) SetListenAddressWithRouter(listenAddress string, r *gin.Engine) {
-	p.listenAddress = listenAddress
-	if len(p.listenAddress) > 0 {
-		p.router = r
-	}
-}
+	// ExcludeClientWriteTime records the request duration up to the last write of the response,
+	// less the time spent blocked in writes, so that slow downloading clients don't inflate
+	// server latencies
+	ExcludeClientWriteTime bool
 
-// SetMetricsPath set metrics paths
-func (p *Prometheus) SetMetricsPath(e *gin.Engine) {
+	// SnapshotInterval is the interval at which OnSnapshot is called with the gathered metrics,
+	// snapshots are disabled if zero
+	SnapshotInterval time.Duration
 
-	if p.listenAddress != "" {
-		p.router.GET(p.MetricsPath, prometheusHandler())
-		p.runServer()
-	} else {
-		e.GET(p.MetricsPath, prometheusHandler())
-	}
-}
+	// OnSnapshot receives the gathered metric families every SnapshotInterval, e.g. to persist
+	// them to a long-term storage
+	OnSnapshot func(families []*dto.MetricFamily)
 
-// SetMetricsPathWithAuth set metrics paths with authentication
-func (p *Prometheus) SetMetricsPathWithAuth(e *gin.Engine, accounts gin.Accounts) {
+	// SnapshotReset resets the metric vectors after each snapshot. Plain counters, gauges,
+	// histograms and summaries can't be reset and keep accumulating
+	SnapshotReset bool
 
-	if p.listenAddress != "" {
-		p.router.GET(p.MetricsPath, gin.BasicAuth(accounts), prometheusHandler())
-		p.runServer()
-	} else {
-		e.GET(p.MetricsPath, gin.BasicAuth(accounts), prometheusHandler())
-	}
+	// JSONMetricsPath exposes a compact JSON summary of the request counter on this path,
+	// alongside the metrics path, for consumers that can't parse the exposition format
+	JSONMetricsPath string
 
-}
+	// DashboardPath serves on this path a minimal HTML page with the request counts, error rates
+	// and latency quantiles of every url, for quick inspection without Grafana. Empty disables it
+	DashboardPath string
 
-func (p *Prometheus) runServer() {
-	if p.listenAddress != "" {
-		go p.router.Run(p.listenAddress)
-	}
-}
+	// LabelHook is called with the labels of the request counter, then with the labels of the
+	// request duration histogram, right before they are recorded and may rewrite their values,
+	// e.g. to redact them. Keys which aren't labels of the metric are ignored
+	LabelHook func(c *gin.Context, labels prometheus.Labels)
 
-func (p *Prometheus) getMetrics() []byte {
-	response, _ := http.Get(p.Ppg.MetricsURL)
+	// LabelValueAllowlists are the allowed values of labels of the request count and duration,
+	// e.g. {"method": {"GET", "POST"}}. Other values are recorded as OtherLabelValue, after the
+	// LabelHook
+	LabelValueAllowlists map[string][]string
 
-	defer response.Body.Close()
-	body, _ := ioutil.ReadAll(response.Body)
+	// PathSource selects the path compared against the metrics path and used as the default url
+	// label, defaults to URLPath
+	PathSource PathSource
 
-	return body
-}
+	// EnableFrameworkInfo registers a gin_framework_info gauge, always 1, labeled with the
+	// gin version in use
+	EnableFrameworkInfo bool
 
-func (p *Prometheus) getPushGatewayURL() string {
-	h, _ := os.Hostname()
-	if p.Ppg.Job == "" {
-		p.Ppg.Job = "gin"
-	}
-	return p.Ppg.PushGatewayURL + "/metrics/job/" + p.Ppg.Job + "/instance/" + h
-}
+	// DefaultStatusCode is recorded as the code label when the observed status is 0, e.g. with
+	// a wrapping writer which doesn't report the status. Any other status, gin's default 200
+	// included, is recorded as is. A 0 status is recorded as is if unset
+	DefaultStatusCode int
 
-func (p *Prometheus) sendMetricsToPushGateway(metrics []byte) {
-	req, err := http.NewRequest("POST", p.getPushGatewayURL(), bytes.NewBuffer(metrics))
-	client := &http.Client{}
-	if _, err = client.Do(req); err != nil {
-		log.WithError(err).Errorln("Error sending to push gateway")
-	}
-}
+	// SplitDurationHistograms replaces request_duration_seconds with two histograms:
+	// request_duration_fast_seconds with fine-grained buckets for requests under a second, and
+	// request_duration_slow_seconds with coarse buckets for the others. See the README for
+	// querying their union
+	SplitDurationHistograms bool
 
-func (p *Prometheus) startPushTicker() {
-	ticker := time.NewTicker(time.Second * p.Ppg.PushIntervalSeconds)
-	go func() {
-		for range ticker.C {
-			p.sendMetricsToPushGateway(p.getMetrics())
-		}
-	}()
-}
+	// MinSizeToObserve skips request and response sizes smaller than this number of bytes
+	// from the size summaries
+	MinSizeToObserve int
 
-// NewMetric associates prometheus.Collector based on Metric.Type
-func NewMetric(m *Metric, subsystem string) prometheus.Collector {
-	var metric prometheus.Collector
-	switch m.Type {
-	case "counter_vec":
-		metric = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Subsystem: subsystem,
-				Name:      m.Name,
-				Help:      m.Description,
-			},
-			m.Args,
-		)
-	case "counter":
-		metric = prometheus.NewCounter(
-			prometheus.CounterOpts{
-				Subsystem: subsystem,
-				Name:      m.Name,
-				Help:      m.Description,
-			},
-		)
-	case "gauge_vec":
-		metric = prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Subsystem: subsystem,
-				Name:      m.Name,
-				Help:      m.Description,
-			},
-			m.Args,
-		)
-	case "gauge":
-		metric = prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Subsystem: subsystem,
-				Name:      m.Name,
-				Help:      m.Description,
-			},
-		)
-	case "histogram_vec":
-		metric = prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Subsystem: subsystem,
-				Name:      m.Name,
-				Help:      m.Description,
-			},
-			m.Args,
-		)
-	case "histogram":
-		metric = prometheus.NewHistogram(
-			prometheus.HistogramOpts{
-				Subsystem: subsystem,
-				Name:      m.Name,
-				Help:      m.Description,
-			},
-		)
-	case "summary_vec":
-		metric = prometheus.NewSummaryVec(
-			prometheus.SummaryOpts{
-				Subsystem: subsystem,
-				Name:      m.Name,
-				Help:      m.Description,
-			},
-			m.Args,
-		)
-	case "summary":
-		metric = prometheus.NewSummary(
-			prometheus.SummaryOpts{
-				Subsystem: subsystem,
-				Name:      m.Name,
-				Help:      m.Description,
-			},
-		)
-	}
-	return metric
-}
+	// EnableConfigInfo registers a ginprometheus_config_info gauge under the subsystem, always 1,
+	// labeled with the boolean toggles of the Config, e.g. split_duration_histograms="true"
+	EnableConfigInfo bool
 
-func (p *Prometheus) registerMetrics(subsystem string) {
+	// SkipZeroDuration skips observing requests whose duration is zero, e.g. because of the
+	// clock resolution. Negative durations, from clock adjustments, are always recorded as zero
+	SkipZeroDuration bool
 
-	for _, metricDef := range p.MetricsList {
-		metric := NewMetric(metricDef, subsystem)
-		if err := prometheus.Register(metric); err != nil {
-			log.WithError(err).Errorf("%s could not be registered in Prometheus", metricDef.Name)
-		}
-		switch metricDef {
-		case reqCnt:
-			p.reqCnt = metric.(*prometheus.CounterVec)
-		case reqDur:
-			p.reqDur = metric.(*prometheus.HistogramVec)
-		case resSz:
-			p.resSz = metric.(prometheus.Summary)
-		case reqSz:
-			p.reqSz = metric.(prometheus.Summary)
-		}
-		metricDef.MetricCollector = metric
-	}
-}
+	// HandlerLabelFromRoute sets the handler label to the route template, i.e. c.FullPath(),
+	// instead of the handler name, to tell apart routes sharing the same handler function
+	HandlerLabelFromRoute bool
 
-// Use adds the middleware to a gin engine.
-func (p *Prometheus) Use(e *gin.Engine) {
-	e.Use(p.HandlerFunc())
-	p.SetMetricsPath(e)
-}
+	// RoleFn adds a role label to the request counter, e.g. admin, user or anonymous as set by an
+	// authentication middleware. It must return one of a small, bounded set of values
+	RoleFn func(c *gin.Context) string
 
-// UseWithAuth adds the middleware to a gin engine with BasicAuth.
-func (p *Prometheus) UseWithAuth(e *gin.Engine, accounts gin.Accounts) {
-	e.Use(p.HandlerFunc())
-	p.SetMetricsPathWithAuth(e, accounts)
-}
+	// MeasureSelfOverhead registers an instrumentation_overhead_seconds summary observing the
+	// time spent by the middleware itself on each request, excluding the handlers
+	MeasureSelfOverhead bool
 
-// HandlerFunc defines handler function for middleware
+	// TrackScrapeDuration registers a scrape_duration_seconds histogram observing the time spent
+	// serving the metrics path
+	TrackScrapeDuration bool
+
+	// EmitLowCardinalityMirror registers a requests_total_low_cardinality counter, partitioned
+	// only by status code class (e.g. 2xx) and method, incremented alongside requests_total
+	EmitLowCardinalityMirror bool
+
+	// ExpositionFormat forces the format the metrics are exposed in regardless of the Accept
+	// header of the scrape, defaults to NegotiateFormat
+	ExpositionFormat ExpositionFormat
+
+	// SplitReadWriteDuration replaces request_duration_seconds with two histograms:
+	// request_read_duration_seconds for GET, HEAD, OPTIONS and TRACE requests, and
+	// request_write_duration_seconds for the other methods. It can be combined with
+	// SplitDurationHistograms, in which case both pairs of histograms are observed
+	SplitReadWriteDuration bool
+
+	// IgnorePaths are paths, as selected by PathSource, of requests which aren't recorded, e.g.
+	// health checks. Like the metrics path, the body and size of these requests aren't read
+	IgnorePaths []string
+
+	// IgnoreMethods are methods of requests which aren't recorded, e.g. OPTIONS
+	IgnoreMethods []string
+
+	// RequestIDHeader is a request header, e.g. X-Request-Id, whose value is attached as a
+	// request_id exemplar to the request duration observations. It is never used as a label,
+	// which would create a series per request. Exemplars are only exposed to scrapes negotiating
+	// the OpenMetrics format, which is enabled by this option
+	RequestIDHeader string
+
+	// MetricsRouterUseDefault creates the router of SetListenAddress with gin.Default(), which
+	// logs every scrape, instead of gin.New()
+	MetricsRouterUseDefault bool
+
+	// TrackSimpleCounter registers a requests_served_total counter without labels, a cheap
+	// alternative to requests_total for liveness checks
+	TrackSimpleCounter bool
+
+	// MountLabel adds a mount label to the request counter, set to the label given to
+	// UseOnGroupWithLabel for requests of that group, and empty otherwise
+	MountLabel bool
+
+	// RouteLabels adds static labels to the request counter for requests matching a route
+	// template, i.e. c.FullPath(), or a template prefix ending with "*", e.g.
+	// {"/billing/*": {"team": "payments"}}. All templates must declare the same label keys,
+	// which are empty for requests matching no template
+	RouteLabels map[string]map[string]string
+
+	// TrackColdStart registers a cold_start_duration_seconds gauge set to the duration of the
+	// first request recorded by the middleware
+	TrackColdStart bool
+
+	// DiagnosticHeaders are request headers whose number of distinct values is exposed in a
+	// header_cardinality gauge, to debug label cardinality. Values are tracked as hashes, up to
+	// 10000 per header
+	DiagnosticHeaders []string
+
+	// FailFast makes NewWithConfigE return the first error registering the metrics, after
+	// unregistering those already registered. Otherwise errors are logged and the metrics which
+	// could be registered are kept
+	FailFast bool
+
+	// TrackRenderTime registers a render_duration_seconds histogram observing the time from the
+	// first write of the response body to the end of the request, separating the rendering of
+	// the response from the handler logic
+	TrackRenderTime bool
+
+	// ExemplarFromContext returns exemplar labels attached to the request duration observations,
+	// e.g. TraceparentExemplar. Like RequestIDHeader, it enables the OpenMetrics format
+	ExemplarFromContext ExemplarFromContextFn
+
+	// ExemplarResponseHeaders are response headers, e.g. X-Request-Id, whose values are attached
+	// as exemplar labels named after them, e.g. x_request_id, to the request duration
+	// observations. Headers which would exceed the length allowed by OpenMetrics are skipped, in
+	// order. Like RequestIDHeader, it enables the OpenMetrics format
+	ExemplarResponseHeaders []string
+
+	// MaxLabelValueLength caps the length in runes of every label value recorded by the
+	// middleware, truncating longer values with an ellipsis. 0 means no cap
+	MaxLabelValueLength int
+
+	// URLLabelMethods restricts the per-url series to requests with one of these methods. The url
+	// label of other requests is replaced by AggregatedURLLabel. Empty means all methods
+	URLLabelMethods []string
+
+	// DurationAlsoSummary observes the request duration into a request_duration_summary_seconds
+	// summary alongside the histogram(s), for server computed quantiles. Summaries are costlier
+	// than histograms: each series keeps a sliding window of observations and observing takes a
+	// lock, and their quantiles can't be aggregated across instances
+	DurationAlsoSummary bool
+
+	// TrackConcurrencyHistogram observes the number of requests in flight, this one included,
+	// into a requests_concurrency histogram at the start of each request
+	TrackConcurrencyHistogram bool
+
+	// SizeHistograms registers the request and response sizes as histograms instead of
+	// summaries, with SizeBuckets
+	SizeHistograms bool
+
+	// SizeBuckets are the buckets in bytes of the size histograms enabled by SizeHistograms,
+	// in ascending order. Defaults to DefaultSizeBuckets
+	SizeBuckets []float64
+
+	// HeadUsesContentLength observes the Content-Length header of the responses to HEAD
+	// requests as their size, i.e. the size of the body of the matching GET, instead of 0
+	HeadUsesContentLength bool
+
+	// TrackWebSocketUpgrades counts the requests answered with 101 Switching Protocols or whose
+	// connection is hijacked, e.g. WebSocket upgrades, into websocket_upgrades_total. Their
+	// duration and response size, meaningless once the connection is taken over, aren't observed
+	TrackWebSocketUpgrades bool
+
+	// TrackRenderErrors counts the requests whose response failed to be written, e.g. c.JSON
+	// writing to a client gone away, into render_errors_total
+	TrackRenderErrors bool
+
+	// TrackBodyReadErrors counts the requests whose body failed to be read or closed, e.g. a
+	// client disconnecting mid-upload or a malformed chunked encoding, into
+	// request_body_read_errors_total
+	TrackBodyReadErrors bool
+
+	// TrackRetryAfter observes the Retry-After header of 429 responses, in seconds or as an HTTP
+	// date, into a retry_after_seconds histogram. Malformed values are skipped
+	TrackRetryAfter bool
+
+	// Track1xx counts the informational responses sent by the handlers before the final
+	// response, e.g. 103 Early Hints flushed with WriteHeaderNow, into
+	// informational_responses_total. A status only set by WriteHeader isn't. The 100 Continue sent
+	// by net/http itself when the body is read isn't counted. Whether or not it is set, the code
+	// label is the final status of the response
+	Track1xx bool
+
+	// AlternateMetricsPath serves the metrics on the first free path among MetricsPath-2,
+	// MetricsPath-3, ... when a route of the engine already handles MetricsPath. By default the
+	// conflict is logged and the metrics path isn't registered
+	AlternateMetricsPath bool
+
+	// CanonicalEndpoint replaces the url label of the standard metrics with a route label set to
+	// the route template of the request, e.g. "/users/:id", keeping the method label separate.
+	// Requests matching no route have an empty route
+	CanonicalEndpoint bool
+
+	// AsyncBufferSize records the metrics of requests in a background goroutine, through a buffer
+	// of this many requests, taking the recording off the request path. 0 records synchronously
+	AsyncBufferSize int
+
+	// DropPolicy is applied when the buffer of AsyncBufferSize is full. Dropped requests are
+	// counted by metrics_dropped_total
+	DropPolicy DropPolicy
+
+	// UpstreamTimeHeader is the response header with the response time in seconds of the
+	// upstream backend, e.g. X-Upstream-Response-Time, observed into upstream_response_seconds.
+	// Comma separated times of several upstreams are summed. Malformed values are skipped
+	UpstreamTimeHeader string
+
+	// TrackMaxHeaderSize observes the size of the largest header value of every request into
+	// max_request_header_bytes, e.g. to detect abusive or misconfigured clients
+	TrackMaxHeaderSize bool
+
+	// LogInterval logs the request counts per url at this interval, e.g. where no Prometheus
+	// server scrapes the metrics. 0 disables it. StopLogging or Shutdown stop it
+	LogInterval time.Duration
+
+	// SelfCheckInterval gathers the metrics of the default registry at this interval and counts
+	// the failures into registry_gather_errors_total, e.g. an inconsistent custom collector,
+	// even when no Prometheus server scrapes them. 0 disables it. StopSelfCheck or Shutdown
+	// stop it
+	SelfCheckInterval time.Duration
+
+	// TrackRequestContentType adds a request_content_type label to the request count, set to the
+	// media type of the Content-Type header of the request, e.g. "application/json", or "none".
+	// Past maxContentTypes distinct values, new media types are counted as "other"
+	TrackRequestContentType bool
+
+	// DurationByHandler labels the duration metrics with the handler label of the request count,
+	// the handler name by default, instead of url, e.g. for handlers shared by several routes
+	DurationByHandler bool
+
+	// Environment adds an env const label with this value, e.g. "staging", to every series of
+	// the standard and custom metrics, which mustn't have an env label. Empty adds no label
+	Environment string
+
+	// ResourceAttributes are OpenTelemetry resource attributes, e.g. {"service.name": "api"},
+	// added as const labels to every series of the standard and custom metrics, their names
+	// normalized to label names, e.g. service_name, which can't be labels of the metrics, e.g.
+	// url or code. The env label of Environment prevails
+	ResourceAttributes map[string]string
+
+	// SummaryMaxAge is the max age of the observations of the summaries without a Metric.MaxAge,
+	// custom ones included, e.g. shorter than the 10m default for short-lived pods
+	SummaryMaxAge time.Duration
+
+	// TrackBodyWriteDuration observes the time from the write of the response header to the end
+	// of the request into body_write_duration_seconds, separating the transfer of the response
+	// body from the handler logic
+	TrackBodyWriteDuration bool
+
+	// DualURLLabels adds to the request count a route label, the template of the matched route,
+	// and a path label, the raw path of the request, e.g. for debugging specific endpoints. Past
+	// maxRawPaths distinct values, new paths are counted as "other". With CanonicalEndpoint, the
+	// route label is already there
+	DualURLLabels bool
+
+	// CustomLabels are labels with constant values added to the request count, e.g.
+	// {"region": "eu-west-1"}. They are registered in the sorted order of their keys, which can't
+	// be labels of the metrics they're added to, e.g. url or code
+	CustomLabels map[string]string
+
+	// CustomLabelScope restricts custom labels to the metrics with the given IDs, e.g.
+	// {"region": {"reqCnt", "reqDur"}}. The duration metrics share their labels, so a label
+	// scoped to any of them applies to all. Labels missing from it only apply to reqCnt
+	CustomLabelScope map[string][]string
+
+	// DynamicLabels are labels added to the request count with the string value of the request
+	// under a gin.Context key, e.g. {"tenant": "tenantID"}, or "" when missing. They're ordered
+	// and scoped with the CustomLabels, and their keys can't be custom labels as well
+	DynamicLabels map[string]string
+
+	// MaxURLCardinality caps the distinct url labels. Past it, requests with new urls are
+	// recorded with OverBudgetURLLabel, a warning is logged once and the
+	// cardinality_budget_exceeded gauge is set to 1. 0 means no cap
+	MaxURLCardinality int
+
+	// StaticRouteLabel replaces the handler and url labels of the requests served by the static
+	// file handlers of gin, e.g. e.Static or e.StaticFS, with this value, e.g. "static". Empty
+	// keeps the file paths as urls
+	StaticRouteLabel string
+
+	// SampleSuccesses samples the duration observations of 2xx responses at SampleSuccessRate,
+	// keeping every observation of other responses. Every request is still counted. It gates
+	// SampleSuccessRate, whose zero value would otherwise drop every 2xx observation of the
+	// configurations which don't set it
+	SampleSuccesses bool
+
+	// SampleSuccessRate is the fraction, from 0 to 1, of the 2xx durations observed when
+	// SampleSuccesses is set
+	SampleSuccessRate float64
+
+	// DurationBuckets are the buckets in seconds of the request duration histogram, and of the
+	// read and write ones of SplitReadWriteDuration. Defaults to prometheus.DefBuckets
+	DurationBuckets []float64
+
+	// ContextValueGauge sets a gauge to a numeric gin.Context value after each request
+	ContextValueGauge ContextValueGauge
+
+	// EnableStageTiming registers middleware_stage_duration_seconds, observed by the handlers
+	// wrapped by TimeStage
+	EnableStageTiming bool
+
+	// TrustForwardedHeaders sets the host label from the X-Forwarded-Host header, falling back
+	// to the Host of the request, e.g. behind a load balancer. Only set it if the header is set
+	// by a trusted proxy, clients could otherwise forge the label
+	TrustForwardedHeaders bool
+
+	// ReuseExistingCollectors adopts the collectors already registered with the name and labels
+	// of a metric, e.g. an http_requests_total of the application, instead of failing, so that
+	// both write to the same series. A collector of another type, or with another help, is a
+	// registration error. The adopted collectors are never unregistered, e.g. by Reconfigure
+	ReuseExistingCollectors bool
+
+	// CacheHitContextKey adds a cache label to the request count, "hit" if the handlers set
+	// true under this gin.Context key, e.g. on an application cache hit, or "miss" otherwise
+	CacheHitContextKey string
+
+	// OperationNameContextKey is the gin.Context key of the logical operation name of the
+	// request, e.g. its OpenAPI operationId, used as url label of the request count and duration.
+	// Requests without a non-empty string under the key keep their path label
+	OperationNameContextKey string
+
+	// ReqCntURLLabelMappingFnWithStatus maps the request to its url label once handled, knowing
+	// the response status, e.g. to group all 404s under "<notfound>" while matched routes keep
+	// their template. The url label mappings of the instance apply when unset
+	ReqCntURLLabelMappingFnWithStatus func(c *gin.Context, status int) string
+
+	// URLReplacements rewrite the url label, applied in order, e.g. UUIDs to :id, after the
+	// url label mappings
+	URLReplacements []URLReplacement
+}
+
+// DefaultSizeBuckets are the default buckets of the size histograms: 256B, 1KB, 64KB, 1MB, 16MB
+var DefaultSizeBuckets = []float64{256, 1 << 10, 64 << 10, 1 << 20, 16 << 20}
+
+// OverBudgetURLLabel is the url label of the requests past Config.MaxURLCardinality
+const OverBudgetURLLabel = "<over-budget>"
+
+// URLReplacement replaces the matches of Pattern in the url label by Replacement, as
+// regexp.Regexp.ReplaceAllString
+type URLReplacement struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// OtherLabelValue is the value of labels not in their Config.LabelValueAllowlists
+const OtherLabelValue = "<other>"
+
+// AggregatedURLLabel is the url label of requests whose method is not in Config.URLLabelMethods
+const AggregatedURLLabel = "<aggregated>"
+
+// validate checks the consistency of the Config
+func (cfg Config) validate() error {
+	for _, m := range cfg.MetricsList {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+	for key, contextKey := range cfg.DynamicLabels {
+		if _, ok := cfg.CustomLabels[key]; ok {
+			return fmt.Errorf("label %s is both a custom and a dynamic label", key)
+		}
+		if contextKey == "" {
+			return fmt.Errorf("dynamic label %s has no context key", key)
+		}
+	}
+	for key, scope := range cfg.CustomLabelScope {
+		_, custom := cfg.CustomLabels[key]
+		_, dynamic := cfg.DynamicLabels[key]
+		if !custom && !dynamic {
+			return fmt.Errorf("custom label scope of %s, which is not a custom or dynamic label", key)
+		}
+		for _, id := range scope {
+			if id != reqCnt.ID && !durationMetricIDs[id] {
+				return fmt.Errorf("custom label %s can't be scoped to metric %s, only to reqCnt and the duration metrics", key, id)
+			}
+		}
+	}
+	for i, replacement := range cfg.URLReplacements {
+		if replacement.Pattern == nil {
+			return fmt.Errorf("url replacement %d has no pattern", i)
+		}
+	}
+	declared := map[string]bool{}
+	for _, subsystem := range cfg.Subsystems {
+		if subsystem == "" || declared[subsystem] {
+			return fmt.Errorf("subsystem %q declared empty or twice", subsystem)
+		}
+		declared[subsystem] = true
+	}
+	normalized := map[string]string{}
+	for name := range cfg.ResourceAttributes {
+		label := resourceLabelName(name)
+		if label == "" || strings.HasPrefix(label, "__") {
+			return fmt.Errorf("resource attribute %q is not a valid label name", name)
+		}
+		if other, ok := normalized[label]; ok {
+			return fmt.Errorf("resource attributes %q and %q are both normalized to %s", other, name, label)
+		}
+		normalized[label] = name
+	}
+	for _, header := range cfg.ExemplarResponseHeaders {
+		if !validLabelName(exemplarLabelName(header)) {
+			return fmt.Errorf("exemplar response header %q doesn't make a valid label name", header)
+		}
+	}
+	if cfg.DurationByHandler {
+		for _, key := range customLabelKeys(cfg, reqDur.ID) {
+			if key == "handler" {
+				return errors.New("custom label handler conflicts with the handler label of DurationByHandler")
+			}
+		}
+	}
+	if cfg.ContextValueGauge.Key != "" {
+		gauge := &Metric{ID: contextGaugeID, Name: cfg.ContextValueGauge.MetricName, Type: "gauge"}
+		if err := gauge.validate(); err != nil {
+			return err
+		}
+	}
+	keys := routeLabelKeys(cfg)
+	for template, labels := range cfg.RouteLabels {
+		if len(labels) != len(keys) {
+			return fmt.Errorf("route labels of %s must have the keys %v", template, keys)
+		}
+		for _, key := range keys {
+			if _, ok := labels[key]; !ok {
+				return fmt.Errorf("route labels of %s must have the keys %v", template, keys)
+			}
+		}
+	}
+	for i := 1; i < len(cfg.SizeBuckets); i++ {
+		if cfg.SizeBuckets[i] <= cfg.SizeBuckets[i-1] {
+			return fmt.Errorf("size buckets must be in ascending order, got %v", cfg.SizeBuckets)
+		}
+	}
+	for i := 1; i < len(cfg.DurationBuckets); i++ {
+		if cfg.DurationBuckets[i] <= cfg.DurationBuckets[i-1] {
+			return fmt.Errorf("duration buckets must be in ascending order, got %v", cfg.DurationBuckets)
+		}
+	}
+	// the custom and dynamic labels mustn't clash with the labels of the metrics they're added to
+	standard := cfg
+	standard.CustomLabels, standard.DynamicLabels = nil, nil
+	for _, m := range standardMetricsList(standard) {
+		id := m.ID
+		if durationMetricIDs[id] {
+			id = reqDur.ID
+		} else if id != reqCnt.ID {
+			continue
+		}
+		for _, key := range customLabelKeys(cfg, id) {
+			for _, arg := range m.Args {
+				if key == arg {
+					return fmt.Errorf("custom label %s conflicts with the %s label of %s", key, arg, m.Name)
+				}
+			}
+		}
+	}
+	// nor the const labels of Environment and ResourceAttributes with those of any metric
+	consts := constLabels(cfg)
+	for _, reserved := range []string{"le", "quantile"} {
+		if _, ok := consts[reserved]; ok {
+			return fmt.Errorf("const label %s is reserved for histograms and summaries", reserved)
+		}
+	}
+	for _, m := range append(append([]*Metric{}, cfg.MetricsList...), standardMetricsList(cfg)...) {
+		for _, arg := range m.Args {
+			if _, ok := consts[arg]; ok {
+				return fmt.Errorf("const label %s of Environment or ResourceAttributes conflicts with a label of %s", arg, m.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// routeLabelKeys returns the sorted label keys of Config.RouteLabels
+func routeLabelKeys(cfg Config) []string {
+	var keys []string
+	for _, labels := range cfg.RouteLabels {
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		break
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// customLabelKeys returns the sorted label keys of Config.CustomLabels and
+// Config.DynamicLabels in the scope of the metric id, reqCnt.ID or reqDur.ID for all the
+// duration metrics, so that the label order registered is the same on every run
+func customLabelKeys(cfg Config, id string) []string {
+	all := make([]string, 0, len(cfg.CustomLabels)+len(cfg.DynamicLabels))
+	for key := range cfg.CustomLabels {
+		all = append(all, key)
+	}
+	for key := range cfg.DynamicLabels {
+		all = append(all, key)
+	}
+	keys := make([]string, 0, len(all))
+	for _, key := range all {
+		scope, ok := cfg.CustomLabelScope[key]
+		if !ok {
+			scope = []string{reqCnt.ID}
+		}
+		for _, scoped := range scope {
+			if scoped == id || (id == reqDur.ID && durationMetricIDs[scoped]) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// durationMetricIDs are the IDs of the duration metrics, which share their labels
+var durationMetricIDs = map[string]bool{
+	reqDur.ID: true, reqDurFast.ID: true, reqDurSlow.ID: true,
+	reqDurRead.ID: true, reqDurWrite.ID: true, reqDurSummary.ID: true,
+}
+
+// customLabel is the constant value of a custom label, or the gin.Context key of the value of
+// a dynamic label
+type customLabel struct {
+	value      string
+	contextKey string
+}
+
+// customLabelsFor returns the custom and dynamic labels in the scope of the metric id, in the
+// order of their keys. They're computed once so that requests fill the label values in the
+// registered order without building maps
+func customLabelsFor(cfg Config, id string) []customLabel {
+	keys := customLabelKeys(cfg, id)
+	labels := make([]customLabel, len(keys))
+	for i, key := range keys {
+		if contextKey, ok := cfg.DynamicLabels[key]; ok {
+			labels[i] = customLabel{contextKey: contextKey}
+		} else {
+			labels[i] = customLabel{value: cfg.CustomLabels[key]}
+		}
+	}
+	return labels
+}
+
+// appendCustomLabels appends the values of the custom and dynamic labels of the request
+func appendCustomLabels(values []string, labels []customLabel, c *gin.Context) []string {
+	for _, label := range labels {
+		if label.contextKey != "" {
+			values = append(values, c.GetString(label.contextKey))
+		} else {
+			values = append(values, label.value)
+		}
+	}
+	return values
+}
+
+// NewPrometheus generates a new set of metrics with a certain subsystem name
+func NewPrometheus(subsystem string, customMetricsList ...[]*Metric) *Prometheus {
+
+	var metricsList []*Metric
+
+	if len(customMetricsList) > 1 {
+		panic("Too many args. NewPrometheus( string, <optional []*Metric> ).")
+	} else if len(customMetricsList) == 1 {
+		metricsList = customMetricsList[0]
+	}
+
+	p, _ := newPrometheus(Config{Subsystem: subsystem, MetricsList: metricsList})
+	return p
+}
+
+// NewWithConfig generates a new set of metrics from a Config, panicking on the errors returned
+// by NewWithConfigE
+func NewWithConfig(cfg Config) *Prometheus {
+	p, err := NewWithConfigE(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// ProductionDefaults returns the Config of NewProductionDefaults, to be adjusted before calling
+// NewWithConfig
+func ProductionDefaults(subsystem string) Config {
+	return Config{
+		Subsystem: subsystem,
+		// url labels are route templates, e.g. "/users/:id", instead of raw paths
+		PathSource: FullPath,
+		// probes would dominate the request counts
+		IgnorePaths: []string{"/healthz", "/readyz"},
+		// bounds the series in case a url mapping still leaks raw paths
+		MaxURLCardinality: 1000,
+		// from 5ms to 30s, covering slow requests past the 10s of prometheus.DefBuckets
+		DurationBuckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}
+}
+
+// NewProductionDefaults generates a new set of metrics with defaults suited to most production
+// services, see ProductionDefaults
+func NewProductionDefaults(subsystem string) *Prometheus {
+	return NewWithConfig(ProductionDefaults(subsystem))
+}
+
+// NewWithConfigE generates a new set of metrics from a Config, returning an error if the Config
+// is invalid, or if a metric could not be registered and Config.FailFast is set
+func NewWithConfigE(cfg Config) (*Prometheus, error) {
+	if cfg.Subsystem == "" {
+		cfg.Subsystem = DefaultSubsystem
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return newPrometheus(cfg)
+}
+
+func newPrometheus(cfg Config) (*Prometheus, error) {
+
+	p := &Prometheus{
+		subsystem:       cfg.Subsystem,
+		config:          cfg,
+		routeKeys:       routeLabelKeys(cfg),
+		customLabels:    customLabelsFor(cfg, reqCnt.ID),
+		customDurLabels: customLabelsFor(cfg, reqDur.ID),
+		allowlists:      labelAllowlists(cfg),
+		MetricsList:     append(append([]*Metric{}, cfg.MetricsList...), standardMetricsList(cfg)...),
+		MetricsPath:     defaultMetricPath,
+		serverErrs:      make(chan error, 1),
+	}
+	p.ReqCntURLLabelMappingFn = p.defaultURLLabel
+
+	var err error
+	p.metrics, err = registerMetrics(p.MetricsList, p.subsystem, prometheus.DefaultRegisterer, metricDefaultsOf(cfg), cfg.FailFast, cfg.ReuseExistingCollectors)
+	if err != nil {
+		return nil, err
+	}
+	p.subsystemSets, p.subsystemList, err = registerSubsystems(cfg, cfg.FailFast)
+	if err != nil {
+		unregisterMetrics(p.MetricsList)
+		return nil, err
+	}
+	if cfg.EnableFrameworkInfo {
+		registerFrameworkInfo()
+	}
+	if cfg.EnableConfigInfo {
+		p.configInfo = registerConfigInfo(cfg)
+	}
+
+	if cfg.SnapshotInterval > 0 && cfg.OnSnapshot != nil {
+		p.startSnapshotTicker()
+	}
+	if cfg.AsyncBufferSize > 0 {
+		p.startRecorder()
+	}
+	if cfg.LogInterval > 0 {
+		p.startLogTicker()
+	}
+	if cfg.SelfCheckInterval > 0 {
+		p.startSelfCheck()
+	}
+
+	return p, nil
+}
+
+// WithConfig adjusts the configuration of the instance with fn, e.g. to enable the Config flags
+// on an instance created by NewPrometheus:
+//
+//	p := NewPrometheus("gin").WithConfig(func(cfg *Config) { cfg.TrackRenderErrors = true })
+//
+// The metrics are registered again as by Reconfigure, and an invalid configuration panics as
+// with NewWithConfig
+func (p *Prometheus) WithConfig(fn func(cfg *Config)) *Prometheus {
+	p.reconfigMu.RLock()
+	cfg := p.config
+	p.reconfigMu.RUnlock()
+	fn(&cfg)
+	if err := p.Reconfigure(cfg); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// WithRuntimeCollectors registers the Go runtime and process collectors in reg, e.g. the
+// registry later passed to UseWithRegistry, which lets instances created by NewPrometheus serve
+// them on a registry of their own. The default registry already has them. Collectors already
+// registered in reg are kept
+func (p *Prometheus) WithRuntimeCollectors(reg prometheus.Registerer) *Prometheus {
+	for _, collector := range []prometheus.Collector{
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	} {
+		if err := reg.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				log.WithError(err).Errorln("Runtime collector could not be registered in Prometheus")
+			}
+		}
+	}
+	return p
+}
+
+// Reconfigure replaces the configuration of the instance, e.g. on a configuration reload. The
+// standard metrics and those of cfg.MetricsList are unregistered from the default registry and
+// registered again with the new configuration, e.g. subsystem. In-flight requests are recorded
+// with the new configuration. On error, the previous configuration and metrics are kept. The
+// metrics served on a separate registry by UseWithRegistry aren't affected
+func (p *Prometheus) Reconfigure(cfg Config) error {
+	if cfg.Subsystem == "" {
+		cfg.Subsystem = DefaultSubsystem
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	p.reconfigMu.Lock()
+	defer p.reconfigMu.Unlock()
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+
+	previous := make([]Metric, len(p.MetricsList))
+	for i, metricDef := range p.MetricsList {
+		previous[i] = *metricDef
+	}
+	unregisterMetrics(p.MetricsList)
+	unregisterMetrics(p.subsystemList)
+	restore := func() {
+		for i, metricDef := range p.MetricsList {
+			metricDef.MetricCollector, metricDef.adopted = previous[i].MetricCollector, previous[i].adopted
+			if metricDef.MetricCollector != nil && !metricDef.adopted {
+				prometheus.DefaultRegisterer.Register(metricDef.MetricCollector)
+			}
+		}
+		for _, metricDef := range p.subsystemList {
+			if metricDef.MetricCollector != nil && !metricDef.adopted {
+				prometheus.DefaultRegisterer.Register(metricDef.MetricCollector)
+			}
+		}
+	}
+
+	metricsList := append(append([]*Metric{}, cfg.MetricsList...), standardMetricsList(cfg)...)
+	// the metrics registered by RegisterMetric are kept
+	for _, runtimeMetric := range p.runtimeMetrics {
+		if !hasMetric(metricsList, runtimeMetric.ID) {
+			metricsList = append(metricsList, runtimeMetric)
+		}
+	}
+	metrics, err := registerMetrics(metricsList, cfg.Subsystem, prometheus.DefaultRegisterer, metricDefaultsOf(cfg), true, cfg.ReuseExistingCollectors)
+	if err != nil {
+		restore()
+		return err
+	}
+	subsystemSets, subsystemList, err := registerSubsystems(cfg, true)
+	if err != nil {
+		unregisterMetrics(metricsList)
+		restore()
+		return err
+	}
+
+	// no request is being queued while reconfigMu is held, and the queued recordings don't lock
+	// it, so the recorder can be drained and replaced before the metric sets are swapped
+	if p.recordings != nil && cfg.AsyncBufferSize != p.config.AsyncBufferSize {
+		close(p.recordings)
+		<-p.recorderDone
+		p.recordings, p.recorderDone = nil, nil
+	}
+	p.metrics = metrics
+	p.MetricsList = metricsList
+	p.subsystemSets = subsystemSets
+	p.subsystemList = subsystemList
+	p.subsystem = cfg.Subsystem
+	p.config = cfg
+	p.routeKeys = routeLabelKeys(cfg)
+	p.customLabels = customLabelsFor(cfg, reqCnt.ID)
+	p.customDurLabels = customLabelsFor(cfg, reqDur.ID)
+	p.allowlists = labelAllowlists(cfg)
+	if p.recordings == nil && cfg.AsyncBufferSize > 0 {
+		p.startRecorder()
+	}
+	p.StopLogging()
+	if cfg.LogInterval > 0 {
+		p.startLogTicker()
+	}
+	p.StopSelfCheck()
+	if cfg.SelfCheckInterval > 0 {
+		p.startSelfCheck()
+	}
+	p.StopSnapshots()
+	if cfg.SnapshotInterval > 0 && cfg.OnSnapshot != nil {
+		p.startSnapshotTicker()
+	}
+	if cfg.EnableFrameworkInfo {
+		registerFrameworkInfo()
+	}
+	if p.configInfo != nil {
+		prometheus.DefaultRegisterer.Unregister(p.configInfo)
+		p.configInfo = nil
+	}
+	if cfg.EnableConfigInfo {
+		p.configInfo = registerConfigInfo(cfg)
+	}
+	return nil
+}
+
+// hasMetric reports whether metricsList has a metric with the id
+func hasMetric(metricsList []*Metric, id string) bool {
+	for _, metricDef := range metricsList {
+		if metricDef.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Subsystem returns the effective prometheus subsystem of the metrics
+func (p *Prometheus) Subsystem() string {
+	return p.subsystem
+}
+
+// SetURLMapping sets the function mapping the url label of requests matching the route template,
+// i.e. c.FullPath(), in place of ReqCntURLLabelMappingFn
+func (p *Prometheus) SetURLMapping(template string, fn RequestCounterURLLabelMappingFn) {
+	p.urlMappingsMu.Lock()
+	defer p.urlMappingsMu.Unlock()
+	if p.urlMappings == nil {
+		p.urlMappings = map[string]RequestCounterURLLabelMappingFn{}
+	}
+	p.urlMappings[template] = fn
+}
+
+// SetPushGateway sends metrics to a remote pushgateway exposed on pushGatewayURL
+// every pushIntervalSeconds. Metrics are fetched from metricsURL
+func (p *Prometheus) SetPushGateway(pushGatewayURL, metricsURL string, pushIntervalSeconds time.Duration) {
+	p.Ppg.PushGatewayURL = pushGatewayURL
+	p.Ppg.MetricsURL = metricsURL
+	p.Ppg.PushIntervalSeconds = pushIntervalSeconds
+	if !p.Ppg.Synchronous {
+		p.startPushTicker()
+	}
+}
+
+// SetPushGatewayJob job name, defaults to "gin"
+func (p *Prometheus) SetPushGatewayJob(j string) {
+	p.Ppg.Job = j
+}
+
+// SetListenAddress for exposing metrics on address. If not set, it will be exposed at the
+// same address of the gin engine that is being used. The metrics router doesn't log scrapes
+// unless Config.MetricsRouterUseDefault is set
+func (p *Prometheus) SetListenAddress(address string) {
+	p.SetListenAddressWithMode(address, p.config.MetricsRouterUseDefault)
+}
+
+// SetListenAddressWithMode is SetListenAddress creating the metrics router with gin.Default(),
+// which logs every scrape, if useDefault is set, or gin.New() otherwise
+func (p *Prometheus) SetListenAddressWithMode(address string, useDefault bool) {
+	p.listenAddress = address
+	if p.listenAddress != "" {
+		if useDefault {
+			p.router = gin.Default()
+		} else {
+			p.router = gin.New()
+		}
+	}
+}
+
+// SetListenAddressWithRouter for using a separate router to expose metrics. (this keeps things like GET /metrics out of
+// your content's access log).
+func (p *Prometheus) SetListenAddressWithRouter(listenAddress string, r *gin.Engine) {
+	p.listenAddress = listenAddress
+	if len(p.listenAddress) > 0 {
+		p.router = r
+	}
+}
+
+// SetMetricsPath set metrics paths
+func (p *Prometheus) SetMetricsPath(e *gin.Engine) {
+	if err := p.SetMetricsPathE(e); err != nil {
+		log.WithError(err).Errorln("Error setting metrics path")
+	}
+}
+
+// SetMetricsPathE is SetMetricsPath returning the error if the metrics path conflicts with a
+// route, or if the metrics server can't listen on the address set by SetListenAddress. Later
+// errors of the metrics server are sent to ServerErrors
+func (p *Prometheus) SetMetricsPathE(e *gin.Engine) error {
+	return p.setMetricsPath(e)
+}
+
+// SetMetricsPathWithAuth set metrics paths with authentication
+func (p *Prometheus) SetMetricsPathWithAuth(e *gin.Engine, accounts gin.Accounts) {
+	p.SetMetricsPathWithMiddleware(e, gin.BasicAuth(accounts))
+}
+
+// SetMetricsPathWithMiddleware set metrics paths behind arbitrary middleware, e.g. token
+// authentication or an IP allowlist
+func (p *Prometheus) SetMetricsPathWithMiddleware(e *gin.Engine, mw ...gin.HandlerFunc) {
+	if err := p.setMetricsPath(e, mw...); err != nil {
+		log.WithError(err).Errorln("Error setting metrics path")
+	}
+}
+
+// setMetricsPath mounts the metrics paths behind the handlers on the engine, or on the metrics
+// server it starts if SetListenAddress was called
+func (p *Prometheus) setMetricsPath(e *gin.Engine, handlers ...gin.HandlerFunc) error {
+	if err := p.resolveMetricsPath(e); err != nil {
+		return err
+	}
+
+	if p.listenAddress != "" {
+		p.router.GET(p.MetricsPath, append(handlers, p.prometheusHandler())...)
+		p.setJSONMetricsPath(p.router, handlers...)
+		return p.runServer()
+	}
+	e.GET(p.MetricsPath, append(handlers, p.prometheusHandler())...)
+	p.setJSONMetricsPath(e, handlers...)
+	return nil
+}
+
+// CheckMetricsPath returns an error if a GET route of e, the same path or a catch-all, already
+// handles MetricsPath
+func (p *Prometheus) CheckMetricsPath(e *gin.Engine) error {
+	for _, route := range e.Routes() {
+		if route.Method == http.MethodGet && routeConflicts(route.Path, p.MetricsPath) {
+			return fmt.Errorf("metrics path %s conflicts with the route %s %s", p.MetricsPath, route.Method, route.Path)
+		}
+	}
+	return nil
+}
+
+// maxAlternateMetricsPaths bounds the alternate paths tried by Config.AlternateMetricsPath
+const maxAlternateMetricsPaths = 10
+
+// resolveMetricsPath checks MetricsPath against the routes of the engine serving the metrics,
+// switching to an alternate path if Config.AlternateMetricsPath is set. It returns the conflict
+// if the metrics path can't be registered
+func (p *Prometheus) resolveMetricsPath(e *gin.Engine) error {
+	if p.listenAddress != "" {
+		e = p.router
+	}
+	err := p.CheckMetricsPath(e)
+	if err == nil {
+		return nil
+	}
+	if p.config.AlternateMetricsPath {
+		path := p.MetricsPath
+		for i := 2; i < 2+maxAlternateMetricsPaths; i++ {
+			p.MetricsPath = path + "-" + strconv.Itoa(i)
+			if p.CheckMetricsPath(e) == nil {
+				log.WithError(err).Warnf("Serving metrics on %s instead", p.MetricsPath)
+				return nil
+			}
+		}
+		p.MetricsPath = path
+	}
+	return err
+}
+
+// routeMatches reports whether the route template, with :param and *catchAll segments,
+// matches path
+func routeMatches(template, path string) bool {
+	templateSegments := strings.Split(template, "/")
+	pathSegments := strings.Split(path, "/")
+	for i, segment := range templateSegments {
+		if strings.HasPrefix(segment, "*") {
+			return true
+		}
+		if i >= len(pathSegments) {
+			return false
+		}
+		if segment != pathSegments[i] && !strings.HasPrefix(segment, ":") {
+			return false
+		}
+	}
+	return len(templateSegments) == len(pathSegments)
+}
+
+// routeConflicts reports whether the route template, the same path or a *catchAll prefix of it,
+// conflicts with path. A :param segment doesn't, since gin serves static segments alongside it
+func routeConflicts(template, path string) bool {
+	if template == path {
+		return true
+	}
+	i := strings.Index(template, "/*")
+	return i >= 0 && strings.HasPrefix(path+"/", template[:i+1])
+}
+
+func (p *Prometheus) setJSONMetricsPath(e *gin.Engine, handlers ...gin.HandlerFunc) {
+	if p.config.JSONMetricsPath != "" {
+		e.GET(p.config.JSONMetricsPath, append(handlers, p.jsonMetricsHandler())...)
+	}
+	if p.config.DashboardPath != "" {
+		e.GET(p.config.DashboardPath, append(handlers, p.dashboardHandler())...)
+	}
+}
+
+// runServer starts the metrics server, returning the error if it can't listen
+func (p *Prometheus) runServer() error {
+	if p.listenAddress == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", p.listenAddress)
+	if err != nil {
+		return err
+	}
+	p.server = &http.Server{Addr: p.listenAddress, Handler: p.router}
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Errorln("Error serving metrics")
+			select {
+			case p.serverErrs <- err:
+			default:
+			}
+		}
+	}(p.server)
+	return nil
+}
+
+// ServerErrors returns the channel receiving the error of the metrics server if it stops
+// serving, other than on ShutdownMetricsServer
+func (p *Prometheus) ServerErrors() <-chan error {
+	return p.serverErrs
+}
+
+// ShutdownMetricsServer gracefully shuts down the metrics server started on the address set by
+// SetListenAddress, if any
+func (p *Prometheus) ShutdownMetricsServer(ctx context.Context) error {
+	if p.server == nil {
+		return nil
+	}
+	return p.server.Shutdown(ctx)
+}
+
+func (p *Prometheus) getMetrics() []byte {
+	if p.pushFormat() != expfmt.FmtText || p.Ppg.MetricsURL == "" {
+		metrics, err := encodeMetrics(prometheus.DefaultGatherer, p.pushFormat())
+		if err != nil {
+			log.WithError(err).Errorln("Error gathering metrics")
+		}
+		return metrics
+	}
+
+	response, err := http.Get(p.Ppg.MetricsURL)
+	if err != nil {
+		log.WithError(err).Errorln("Error fetching metrics")
+		return nil
+	}
+
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+
+	return body
+}
+
+func (p *Prometheus) pushMethod() (string, error) {
+	switch p.Ppg.Method {
+	case "":
+		return http.MethodPost, nil
+	case http.MethodPost, http.MethodPut:
+		return p.Ppg.Method, nil
+	}
+	return "", fmt.Errorf("invalid push gateway method %q, expected POST or PUT", p.Ppg.Method)
+}
+
+func (p *Prometheus) pushFormat() expfmt.Format {
+	if p.Ppg.Format == "" {
+		return expfmt.FmtText
+	}
+	return p.Ppg.Format
+}
+
+// MarshalText returns the metrics of the default registry in the text exposition format, e.g.
+// for custom push schemes, without scraping the metrics path. The registries passed to
+// UseWithRegistry aren't included
+func (p *Prometheus) MarshalText() ([]byte, error) {
+	return encodeMetrics(prometheus.DefaultGatherer, expfmt.FmtText)
+}
+
+// encodeMetrics gathers the metrics of g and encodes them in format
+func encodeMetrics(g prometheus.Gatherer, format expfmt.Format) ([]byte, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, format)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// pushURL returns the push URL of the instance on the pushgateway at gatewayURL
+func (p *Prometheus) pushURL(gatewayURL string) string {
+	h, _ := os.Hostname()
+	if p.Ppg.Job == "" {
+		p.Ppg.Job = "gin"
+	}
+	return gatewayURL + "/metrics/job/" + p.Ppg.Job + "/instance/" + h
+}
+
+// pushGateways returns the URLs of the pushgateways
+func (p *Prometheus) pushGateways() []string {
+	return append([]string{p.Ppg.PushGatewayURL}, p.Ppg.AdditionalURLs...)
+}
+
+// eachPushGateway calls fn for every pushgateway, returning an error summarizing the failures
+func (p *Prometheus) eachPushGateway(fn func(gatewayURL string) error) error {
+	gateways := p.pushGateways()
+	var failed []string
+	var first error
+	for _, gateway := range gateways {
+		if err := fn(gateway); err != nil {
+			failed = append(failed, gateway)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("%d of %d push gateways failed %v: %w", len(failed), len(gateways), failed, first)
+	}
+	return nil
+}
+
+func (p *Prometheus) sendMetricsToPushGateway(metrics []byte) {
+	if _, err := p.pushMetrics(metrics); err != nil {
+		log.WithError(err).Errorln("Error sending to push gateway")
+	}
+}
+
+func (p *Prometheus) pushMetrics(metrics []byte) ([]PushResult, error) {
+	pushDef := *pushes
+	counter, err := p.RegisterMetric(&pushDef)
+	if err != nil {
+		log.WithError(err).Errorln("Error registering push metrics")
+	}
+	var results []PushResult
+	err = p.eachPushGateway(func(gatewayURL string) error {
+		pushed := p.pushTo(gatewayURL, metrics)
+		results = append(results, pushed)
+		if counter != nil {
+			result := "success"
+			if pushed.Err != nil {
+				result = "failure"
+			}
+			counter.MetricCollector.(*prometheus.CounterVec).WithLabelValues(gatewayURL, result).Inc()
+		}
+		return pushed.Err
+	})
+	return results, err
+}
+
+// PushResult describes a push of the metrics to a pushgateway
+type PushResult struct {
+	// GatewayURL is the URL of the pushgateway
+	GatewayURL string
+	// StatusCode of the response of the pushgateway, 0 if none was received
+	StatusCode int
+	// BytesSent is the size of the pushed metrics
+	BytesSent int
+	// Duration of the push request
+	Duration time.Duration
+	// Err is the error of the push, nil if it succeeded
+	Err error
+}
+
+// pushTo pushes the metrics to the pushgateway at gatewayURL
+func (p *Prometheus) pushTo(gatewayURL string, metrics []byte) PushResult {
+	result := PushResult{GatewayURL: gatewayURL}
+	method, err := p.pushMethod()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req, err := http.NewRequest(method, p.pushURL(gatewayURL), bytes.NewBuffer(metrics))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("Content-Type", string(p.pushFormat()))
+	client := &http.Client{}
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+	result.BytesSent = len(metrics)
+	if resp.StatusCode/100 != 2 {
+		result.Err = fmt.Errorf("unexpected status code %d pushing to push gateway", resp.StatusCode)
+	}
+	return result
+}
+
+// PushNow pushes the current metrics to the pushgateway set by SetPushGateway, e.g. a final
+// push before exiting
+func (p *Prometheus) PushNow() error {
+	_, err := p.pushMetrics(p.getMetrics())
+	return err
+}
+
+// PushNowWithResult pushes the current metrics as PushNow, and returns the result of the push
+// to every pushgateway, e.g. to debug a flaky gateway
+func (p *Prometheus) PushNowWithResult() ([]PushResult, error) {
+	return p.pushMetrics(p.getMetrics())
+}
+
+// PushLoop pushes the metrics to the pushgateway set by SetPushGateway every push interval,
+// blocking the caller until ctx is done, e.g. with PrometheusPushGateway.Synchronous. Failed
+// pushes are logged. It returns an error right away if the push interval isn't positive
+func (p *Prometheus) PushLoop(ctx context.Context) error {
+	if p.Ppg.PushIntervalSeconds <= 0 {
+		return fmt.Errorf("invalid push interval %d, it must be positive", p.Ppg.PushIntervalSeconds)
+	}
+	ticker := time.NewTicker(time.Second * p.Ppg.PushIntervalSeconds)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.sendMetricsToPushGateway(p.getMetrics())
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// DeleteFromPushGateway deletes the metrics pushed by this instance from the pushgateways,
+// e.g. when a batch job finishes
+func (p *Prometheus) DeleteFromPushGateway() error {
+	return p.eachPushGateway(func(gatewayURL string) error {
+		req, err := http.NewRequest(http.MethodDelete, p.pushURL(gatewayURL), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("unexpected status code %d deleting from push gateway", resp.StatusCode)
+		}
+		return nil
+	})
+}
+
+func (p *Prometheus) startPushTicker() {
+	p.StopPushGateway()
+	ticker := time.NewTicker(time.Second * p.Ppg.PushIntervalSeconds)
+	stop := make(chan struct{})
+	p.pushStop = stop
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.sendMetricsToPushGateway(p.getMetrics())
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopPushGateway stops the periodic pushes started by SetPushGateway
+func (p *Prometheus) StopPushGateway() {
+	if p.pushStop != nil {
+		close(p.pushStop)
+		p.pushStop = nil
+	}
+}
+
+func (p *Prometheus) startLogTicker() {
+	ticker := time.NewTicker(p.config.LogInterval)
+	stop := make(chan struct{})
+	p.logStop = stop
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.logRequestCounts()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopLogging stops the periodic logs enabled by Config.LogInterval
+func (p *Prometheus) StopLogging() {
+	if p.logStop != nil {
+		close(p.logStop)
+		p.logStop = nil
+	}
+}
+
+func (p *Prometheus) startSelfCheck() {
+	ticker := time.NewTicker(p.config.SelfCheckInterval)
+	stop := make(chan struct{})
+	p.selfCheckStop = stop
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.selfCheck()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopSelfCheck stops the periodic self-checks enabled by Config.SelfCheckInterval
+func (p *Prometheus) StopSelfCheck() {
+	if p.selfCheckStop != nil {
+		close(p.selfCheckStop)
+		p.selfCheckStop = nil
+	}
+}
+
+// selfCheck gathers the metrics of the default registry and counts a failure
+func (p *Prometheus) selfCheck() {
+	if _, err := prometheus.DefaultGatherer.Gather(); err != nil {
+		log.WithError(err).Warnln("Error gathering metrics")
+		p.reconfigMu.RLock()
+		if p.metrics.gatherErrors != nil {
+			p.metrics.gatherErrors.Inc()
+		}
+		p.reconfigMu.RUnlock()
+	}
+}
+
+// logRequestCounts logs the total request count of every url, sorted by url
+func (p *Prometheus) logRequestCounts() {
+	p.reconfigMu.RLock()
+	reqCnt := p.metrics.reqCnt
+	p.reconfigMu.RUnlock()
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		reqCnt.Collect(ch)
+		close(ch)
+	}()
+	counts := map[string]float64{}
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+		for _, label := range m.GetLabel() {
+			if label.GetName() == "url" || label.GetName() == "route" {
+				counts[label.GetValue()] += m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	urls := make([]string, 0, len(counts))
+	for url := range counts {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	summary := make([]string, len(urls))
+	for i, url := range urls {
+		summary[i] = url + "=" + strconv.FormatFloat(counts[url], 'f', -1, 64)
+	}
+	log.Infof("Request counts: %s", strings.Join(summary, " "))
+}
+
+// Shutdown stops the periodic logs, self-checks, snapshots and pushes, waits for the background
+// recorder to record the queued requests, does a final push if a pushgateway is set and shuts
+// down the metrics server, e.g. on SIGTERM. All steps run, and the first error is returned
+func (p *Prometheus) Shutdown(ctx context.Context) error {
+	var first error
+	p.StopLogging()
+	p.StopSelfCheck()
+	p.StopSnapshots()
+	p.StopPushGateway()
+	if err := p.stopRecorder(ctx); err != nil {
+		first = fmt.Errorf("stopping recorder: %w", err)
+	}
+	if p.Ppg.PushGatewayURL != "" {
+		if err := p.PushNow(); err != nil && first == nil {
+			first = fmt.Errorf("final push: %w", err)
+		}
+	}
+	if err := p.ShutdownMetricsServer(ctx); err != nil && first == nil {
+		first = fmt.Errorf("shutting down metrics server: %w", err)
+	}
+	return first
+}
+
+func (p *Prometheus) startSnapshotTicker() {
+	ticker := time.NewTicker(p.config.SnapshotInterval)
+	stop := make(chan struct{})
+	p.snapshotStop = stop
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.snapshot()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopSnapshots stops the periodic snapshots enabled by Config.SnapshotInterval
+func (p *Prometheus) StopSnapshots() {
+	if p.snapshotStop != nil {
+		close(p.snapshotStop)
+		p.snapshotStop = nil
+	}
+}
+
+func (p *Prometheus) snapshot() {
+	p.reconfigMu.RLock()
+	onSnapshot, reset := p.config.OnSnapshot, p.config.SnapshotReset
+	p.reconfigMu.RUnlock()
+	if onSnapshot == nil {
+		return
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		log.WithError(err).Errorln("Error gathering metrics for snapshot")
+	}
+	onSnapshot(families)
+
+	if reset {
+		p.metricsMu.Lock()
+		defer p.metricsMu.Unlock()
+		for _, metricDef := range p.MetricsList {
+			if vec, ok := metricDef.MetricCollector.(interface{ Reset() }); ok {
+				vec.Reset()
+			}
+		}
+	}
+}
+
+// NewMetric associates prometheus.Collector based on Metric.Type
+func NewMetric(m *Metric, subsystem string) prometheus.Collector {
+	var metric prometheus.Collector
+	switch m.Type {
+	case "counter_vec":
+		metric = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem:   subsystem,
+				Name:        m.Name,
+				Help:        m.Description,
+				ConstLabels: m.ConstLabels,
+			},
+			m.Args,
+		)
+	case "counter":
+		metric = prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Subsystem:   subsystem,
+				Name:        m.Name,
+				Help:        m.Description,
+				ConstLabels: m.ConstLabels,
+			},
+		)
+	case "gauge_vec":
+		metric = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem:   subsystem,
+				Name:        m.Name,
+				Help:        m.Description,
+				ConstLabels: m.ConstLabels,
+			},
+			m.Args,
+		)
+	case "gauge":
+		metric = prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Subsystem:   subsystem,
+				Name:        m.Name,
+				Help:        m.Description,
+				ConstLabels: m.ConstLabels,
+			},
+		)
+	case "histogram_vec":
+		metric = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Subsystem:   subsystem,
+				Name:        m.Name,
+				Help:        m.Description,
+				ConstLabels: m.ConstLabels,
+				Buckets:     m.Buckets,
+			},
+			m.Args,
+		)
+	case "histogram":
+		metric = prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Subsystem:   subsystem,
+				Name:        m.Name,
+				Help:        m.Description,
+				ConstLabels: m.ConstLabels,
+				Buckets:     m.Buckets,
+			},
+		)
+	case "summary_vec":
+		metric = prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Subsystem:   subsystem,
+				Name:        m.Name,
+				Help:        m.Description,
+				ConstLabels: m.ConstLabels,
+				Objectives:  m.Objectives,
+				MaxAge:      m.MaxAge,
+			},
+			m.Args,
+		)
+	case "summary":
+		metric = prometheus.NewSummary(
+			prometheus.SummaryOpts{
+				Subsystem:   subsystem,
+				Name:        m.Name,
+				Help:        m.Description,
+				ConstLabels: m.ConstLabels,
+				Objectives:  m.Objectives,
+				MaxAge:      m.MaxAge,
+			},
+		)
+	}
+	return metric
+}
+
+// standardMetricsList returns copies of the standard metrics, and of the optional ones
+// enabled by the Config
+func standardMetricsList(cfg Config) []*Metric {
+	var metricsList []*Metric
+
+	for _, metric := range standardMetrics {
+		if metric == reqDur && (cfg.SplitDurationHistograms || cfg.SplitReadWriteDuration) {
+			if cfg.SplitDurationHistograms {
+				metricsList = append(metricsList, reqDurFast, reqDurSlow)
+			}
+			if cfg.SplitReadWriteDuration {
+				metricsList = append(metricsList, reqDurRead, reqDurWrite)
+			}
+			continue
+		}
+		metricsList = append(metricsList, metric)
+	}
+	if cfg.TrackRateLimited {
+		metricsList = append(metricsList, reqRateLimited)
+	}
+	if cfg.MeasureSelfOverhead {
+		metricsList = append(metricsList, selfOverhead)
+	}
+	if cfg.TrackScrapeDuration {
+		metricsList = append(metricsList, scrapeDur)
+	}
+	if cfg.EmitLowCardinalityMirror {
+		metricsList = append(metricsList, reqCntLow)
+	}
+	if cfg.TrackSimpleCounter {
+		metricsList = append(metricsList, reqServed)
+	}
+	if cfg.TrackColdStart {
+		metricsList = append(metricsList, coldStart)
+	}
+	if len(cfg.DiagnosticHeaders) > 0 {
+		metricsList = append(metricsList, headerCard)
+	}
+	if cfg.TrackRenderTime {
+		metricsList = append(metricsList, renderDur)
+	}
+	if cfg.DurationAlsoSummary {
+		metricsList = append(metricsList, reqDurSummary)
+	}
+	if cfg.TrackConcurrencyHistogram {
+		metricsList = append(metricsList, reqConcurrency)
+	}
+	if cfg.TrackWebSocketUpgrades {
+		metricsList = append(metricsList, wsUpgrades)
+	}
+	if cfg.TrackRenderErrors {
+		metricsList = append(metricsList, renderErrors)
+	}
+	if cfg.TrackBodyReadErrors {
+		metricsList = append(metricsList, bodyReadErrors)
+	}
+	if cfg.Track1xx {
+		metricsList = append(metricsList, informational)
+	}
+	if cfg.TrackRetryAfter {
+		metricsList = append(metricsList, retryAfter)
+	}
+	if cfg.AsyncBufferSize > 0 {
+		metricsList = append(metricsList, metricsDropped)
+	}
+	if cfg.SelfCheckInterval > 0 {
+		metricsList = append(metricsList, gatherErrors)
+	}
+	if cfg.UpstreamTimeHeader != "" {
+		metricsList = append(metricsList, upstreamDur)
+	}
+	if cfg.TrackMaxHeaderSize {
+		metricsList = append(metricsList, maxHeaderSz)
+	}
+	if cfg.TrackBodyWriteDuration {
+		metricsList = append(metricsList, bodyWriteDur)
+	}
+	if cfg.MaxURLCardinality > 0 {
+		metricsList = append(metricsList, budgetExceeded)
+	}
+	if cfg.EnableStageTiming {
+		metricsList = append(metricsList, stageDur)
+	}
+	if cfg.ContextValueGauge.Key != "" {
+		metricsList = append(metricsList, &Metric{
+			ID:          contextGaugeID,
+			Name:        cfg.ContextValueGauge.MetricName,
+			Description: fmt.Sprintf("The last numeric value of the %q key of the gin context.", cfg.ContextValueGauge.Key),
+			Type:        "gauge"})
+	}
+
+	for i, metric := range metricsList {
+		m := *metric
+		if m.ID == reqCnt.ID && cfg.RoleFn != nil {
+			m.Args = append(append([]string{}, m.Args...), "role")
+		}
+		if m.ID == reqCnt.ID && cfg.MountLabel {
+			m.Args = append(append([]string{}, m.Args...), "mount")
+		}
+		if m.ID == reqCnt.ID && len(cfg.RouteLabels) > 0 {
+			m.Args = append(append([]string{}, m.Args...), routeLabelKeys(cfg)...)
+		}
+		if m.ID == reqCnt.ID && cfg.TrackRequestContentType {
+			m.Args = append(append([]string{}, m.Args...), "request_content_type")
+		}
+		if m.ID == reqCnt.ID && cfg.DualURLLabels {
+			if !cfg.CanonicalEndpoint {
+				m.Args = append(append([]string{}, m.Args...), "route")
+			}
+			m.Args = append(append([]string{}, m.Args...), "path")
+		}
+		if m.ID == reqCnt.ID && len(cfg.CustomLabels)+len(cfg.DynamicLabels) > 0 {
+			m.Args = append(append([]string{}, m.Args...), customLabelKeys(cfg, reqCnt.ID)...)
+		}
+		if durationMetricIDs[m.ID] && len(cfg.CustomLabels)+len(cfg.DynamicLabels) > 0 {
+			m.Args = append(append([]string{}, m.Args...), customLabelKeys(cfg, reqDur.ID)...)
+		}
+		if m.ID == reqCnt.ID && cfg.CacheHitContextKey != "" {
+			m.Args = append(append([]string{}, m.Args...), "cache")
+		}
+		if cfg.CanonicalEndpoint {
+			args := make([]string, len(m.Args))
+			for i, arg := range m.Args {
+				if arg == "url" {
+					arg = "route"
+				}
+				args[i] = arg
+			}
+			m.Args = args
+		}
+		if durationMetricIDs[m.ID] && cfg.DurationByHandler {
+			// the third arg is the url label
+			m.Args = append(append([]string{}, m.Args[:2]...), append([]string{"handler"}, m.Args[3:]...)...)
+		}
+		if (m.ID == reqDur.ID || m.ID == reqDurRead.ID || m.ID == reqDurWrite.ID) && len(cfg.DurationBuckets) > 0 {
+			m.Buckets = cfg.DurationBuckets
+		}
+		if (m.ID == reqSz.ID || m.ID == resSz.ID) && cfg.SizeHistograms {
+			m.Type = "histogram"
+			m.Buckets = cfg.SizeBuckets
+			if len(m.Buckets) == 0 {
+				m.Buckets = DefaultSizeBuckets
+			}
+		}
+		metricsList[i] = &m
+	}
+	return metricsList
+}
+
+// constLabels returns the const labels added to every metric by Config.Environment and
+// Config.ResourceAttributes
+func constLabels(cfg Config) prometheus.Labels {
+	labels := prometheus.Labels{}
+	for name, value := range cfg.ResourceAttributes {
+		labels[resourceLabelName(name)] = value
+	}
+	if cfg.Environment != "" {
+		labels["env"] = cfg.Environment
+	}
+	return labels
+}
+
+// resourceLabelName normalizes an OpenTelemetry resource attribute name to a label name, e.g.
+// service.name to service_name
+func resourceLabelName(name string) string {
+	normalized := []rune(name)
+	for i, r := range normalized {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			normalized[i] = '_'
+		}
+	}
+	return string(normalized)
+}
+
+// registerSubsystems registers a set of the standard metrics in the default registry for every
+// subsystem of Config.Subsystems but Config.Subsystem, and returns the sets by subsystem along
+// with the registered metrics
+func registerSubsystems(cfg Config, failFast bool) (map[string]*metricSet, []*Metric, error) {
+	sets := map[string]*metricSet{}
+	var registered []*Metric
+	for _, subsystem := range cfg.Subsystems {
+		if subsystem == cfg.Subsystem {
+			continue
+		}
+		list := standardMetricsList(cfg)
+		set, err := registerMetrics(list, subsystem, prometheus.DefaultRegisterer, metricDefaultsOf(cfg), failFast, cfg.ReuseExistingCollectors)
+		if err != nil {
+			unregisterMetrics(registered)
+			return nil, nil, err
+		}
+		sets[subsystem] = set
+		registered = append(registered, list...)
+	}
+	return sets, registered, nil
+}
+
+// unregisterMetrics unregisters the collectors of metricsList from the default registry, but
+// the adopted ones
+func unregisterMetrics(metricsList []*Metric) {
+	for _, metricDef := range metricsList {
+		if metricDef.MetricCollector != nil && !metricDef.adopted {
+			prometheus.DefaultRegisterer.Unregister(metricDef.MetricCollector)
+		}
+	}
+}
+
+// metricDefaults are the settings of the Config applied to the metrics when their collectors are
+// created, leaving the Metric definitions, e.g. those of Config.MetricsList, untouched so that
+// a later Reconfigure applies its own
+type metricDefaults struct {
+	summaryMaxAge time.Duration
+	constLabels   prometheus.Labels
+}
+
+func metricDefaultsOf(cfg Config) metricDefaults {
+	return metricDefaults{summaryMaxAge: cfg.SummaryMaxAge, constLabels: constLabels(cfg)}
+}
+
+// apply returns a copy of m with the defaults: the MaxAge of summaries without one, and the
+// const labels, overriding those of m
+func (d metricDefaults) apply(m *Metric) *Metric {
+	applied := *m
+	if (m.Type == "summary" || m.Type == "summary_vec") && m.MaxAge == 0 {
+		applied.MaxAge = d.summaryMaxAge
+	}
+	if len(d.constLabels) > 0 {
+		applied.ConstLabels = prometheus.Labels{}
+		for name, value := range m.ConstLabels {
+			applied.ConstLabels[name] = value
+		}
+		for name, value := range d.constLabels {
+			applied.ConstLabels[name] = value
+		}
+	}
+	return &applied
+}
+
+// registerMetrics registers the metrics in registerer, with the defaults. On error, it either
+// unregisters the metrics already registered and returns the error if failFast is set, or logs
+// it and continues
+func registerMetrics(metricsList []*Metric, subsystem string, registerer prometheus.Registerer, defaults metricDefaults, failFast, reuse bool) (*metricSet, error) {
+	set := &metricSet{}
+	var registered []prometheus.Collector
+
+	for _, metricDef := range metricsList {
+		if err := metricDef.validate(); err != nil {
+			if failFast {
+				for _, collector := range registered {
+					registerer.Unregister(collector)
+				}
+				return nil, err
+			}
+			log.WithError(err).Errorln("Invalid metric not registered")
+			continue
+		}
+		metric := NewMetric(defaults.apply(metricDef), subsystem)
+		adopted := false
+		err := registerer.Register(metric)
+		if err == nil {
+			registered = append(registered, metric)
+		} else if reuse {
+			metric, err = adoptExisting(metric, err)
+			adopted = err == nil
+		}
+		if err != nil {
+			if failFast {
+				for _, collector := range registered {
+					registerer.Unregister(collector)
+				}
+				return nil, fmt.Errorf("%s could not be registered in Prometheus: %w", metricDef.Name, err)
+			}
+			log.WithError(err).Errorf("%s could not be registered in Prometheus", metricDef.Name)
+		}
+		switch metricDef.ID {
+		case reqCnt.ID:
+			set.reqCnt = metric.(*prometheus.CounterVec)
+			set.cntArgs = metricDef.Args
+		case reqDur.ID:
+			set.reqDur = metric.(*prometheus.HistogramVec)
+			set.durArgs = metricDef.Args
+		case reqDurFast.ID:
+			set.reqDurFast = metric.(*prometheus.HistogramVec)
+			set.durArgs = metricDef.Args
+		case reqDurSlow.ID:
+			set.reqDurSlow = metric.(*prometheus.HistogramVec)
+		case reqDurRead.ID:
+			set.reqDurRead = metric.(*prometheus.HistogramVec)
+			set.durArgs = metricDef.Args
+		case reqDurWrite.ID:
+			set.reqDurWrite = metric.(*prometheus.HistogramVec)
+		case resSz.ID:
+			set.resSz = metric.(prometheus.Observer)
+		case reqSz.ID:
+			set.reqSz = metric.(prometheus.Observer)
+		case reqRateLimited.ID:
+			set.reqLimited = metric.(*prometheus.CounterVec)
+		case selfOverhead.ID:
+			set.overhead = metric.(prometheus.Summary)
+		case scrapeDur.ID:
+			set.scrapeDur = metric.(prometheus.Histogram)
+		case reqCntLow.ID:
+			set.reqCntLow = metric.(*prometheus.CounterVec)
+		case reqServed.ID:
+			set.reqServed = metric.(prometheus.Counter)
+		case coldStart.ID:
+			set.coldStart = metric.(prometheus.Gauge)
+		case renderDur.ID:
+			set.renderDur = metric.(*prometheus.HistogramVec)
+		case reqDurSummary.ID:
+			set.reqDurSummary = metric.(*prometheus.SummaryVec)
+		case reqConcurrency.ID:
+			set.concurrency = metric.(prometheus.Histogram)
+		case wsUpgrades.ID:
+			set.wsUpgrades = metric.(*prometheus.CounterVec)
+		case renderErrors.ID:
+			set.renderErrors = metric.(*prometheus.CounterVec)
+		case bodyReadErrors.ID:
+			set.bodyReadErrors = metric.(*prometheus.CounterVec)
+		case informational.ID:
+			set.informational = metric.(*prometheus.CounterVec)
+		case retryAfter.ID:
+			set.retryAfter = metric.(prometheus.Histogram)
+		case metricsDropped.ID:
+			set.dropped = metric.(prometheus.Counter)
+		case gatherErrors.ID:
+			set.gatherErrors = metric.(prometheus.Counter)
+		case upstreamDur.ID:
+			set.upstreamDur = metric.(prometheus.Histogram)
+		case maxHeaderSz.ID:
+			set.maxHeaderSz = metric.(prometheus.Histogram)
+		case bodyWriteDur.ID:
+			set.bodyWriteDur = metric.(*prometheus.HistogramVec)
+		case budgetExceeded.ID:
+			set.budgetExceeded = metric.(prometheus.Gauge)
+		case contextGaugeID:
+			set.contextGauge = metric.(prometheus.Gauge)
+		case stageDur.ID:
+			set.stageDur = metric.(*prometheus.HistogramVec)
+		case headerCard.ID:
+			set.headerCard = metric.(*prometheus.GaugeVec)
+			set.headerSeen = map[string]map[uint64]struct{}{}
+		}
+		metricDef.MetricCollector = metric
+		metricDef.adopted = adopted
+	}
+	return set, nil
+}
+
+// adoptExisting returns the collector already registered in place of metric, if err is an
+// AlreadyRegisteredError. Prometheus only returns it for the same name, help and label names,
+// so the existing collector must only be of the same type. Any other error, e.g. for the same
+// name with another help, means there is no collector to adopt
+func adoptExisting(metric prometheus.Collector, err error) (prometheus.Collector, error) {
+	are, ok := err.(prometheus.AlreadyRegisteredError)
+	if !ok {
+		return metric, fmt.Errorf("no collector to reuse, the existing one must have the same help and labels: %w", err)
+	}
+	if reflect.TypeOf(are.ExistingCollector) != reflect.TypeOf(metric) {
+		return metric, fmt.Errorf("existing collector is a %T instead of a %T: %w", are.ExistingCollector, metric, err)
+	}
+	return are.ExistingCollector, nil
+}
+
+func registerFrameworkInfo() {
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "gin_framework_info",
+		Help:        "Information about the gin framework, labeled by its version.",
+		ConstLabels: prometheus.Labels{"gin_version": gin.Version},
+	})
+	info.Set(1)
+	if err := prometheus.Register(info); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			log.WithError(err).Errorln("gin_framework_info could not be registered in Prometheus")
+		}
+	}
+}
+
+func registerConfigInfo(cfg Config) prometheus.Collector {
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem:   cfg.Subsystem,
+		Name:        "ginprometheus_config_info",
+		Help:        "The configuration of the gin prometheus middleware.",
+		ConstLabels: configLabels(cfg),
+	})
+	info.Set(1)
+	if err := prometheus.Register(info); err != nil {
+		log.WithError(err).Errorln("ginprometheus_config_info could not be registered in Prometheus")
+		return nil
+	}
+	return info
+}
+
+// configLabels returns the boolean toggles of the Config as labels. New toggles must be added
+// here to be reported
+func configLabels(cfg Config) prometheus.Labels {
+	toggles := []struct {
+		name  string
+		value bool
+	}{
+		{"track_rate_limited", cfg.TrackRateLimited},
+		{"exclude_body_read_from_duration", cfg.ExcludeBodyReadFromDuration},
+		{"exclude_client_write_time", cfg.ExcludeClientWriteTime},
+		{"snapshot_reset", cfg.SnapshotReset},
+		{"enable_framework_info", cfg.EnableFrameworkInfo},
+		{"split_duration_histograms", cfg.SplitDurationHistograms},
+		{"enable_config_info", cfg.EnableConfigInfo},
+		{"skip_zero_duration", cfg.SkipZeroDuration},
+		{"handler_label_from_route", cfg.HandlerLabelFromRoute},
+		{"measure_self_overhead", cfg.MeasureSelfOverhead},
+		{"track_scrape_duration", cfg.TrackScrapeDuration},
+		{"emit_low_cardinality_mirror", cfg.EmitLowCardinalityMirror},
+		{"split_read_write_duration", cfg.SplitReadWriteDuration},
+		{"metrics_router_use_default", cfg.MetricsRouterUseDefault},
+		{"track_simple_counter", cfg.TrackSimpleCounter},
+		{"mount_label", cfg.MountLabel},
+		{"track_cold_start", cfg.TrackColdStart},
+		{"fail_fast", cfg.FailFast},
+		{"track_render_time", cfg.TrackRenderTime},
+		{"duration_also_summary", cfg.DurationAlsoSummary},
+		{"track_concurrency_histogram", cfg.TrackConcurrencyHistogram},
+		{"size_histograms", cfg.SizeHistograms},
+		{"head_uses_content_length", cfg.HeadUsesContentLength},
+		{"track_web_socket_upgrades", cfg.TrackWebSocketUpgrades},
+		{"track_render_errors", cfg.TrackRenderErrors},
+		{"track_body_read_errors", cfg.TrackBodyReadErrors},
+		{"track_retry_after", cfg.TrackRetryAfter},
+		{"track_1xx", cfg.Track1xx},
+		{"alternate_metrics_path", cfg.AlternateMetricsPath},
+		{"canonical_endpoint", cfg.CanonicalEndpoint},
+		{"track_max_header_size", cfg.TrackMaxHeaderSize},
+		{"track_request_content_type", cfg.TrackRequestContentType},
+		{"duration_by_handler", cfg.DurationByHandler},
+		{"track_body_write_duration", cfg.TrackBodyWriteDuration},
+		{"dual_url_labels", cfg.DualURLLabels},
+		{"sample_successes", cfg.SampleSuccesses},
+		{"enable_stage_timing", cfg.EnableStageTiming},
+		{"trust_forwarded_headers", cfg.TrustForwardedHeaders},
+		{"reuse_existing_collectors", cfg.ReuseExistingCollectors},
+	}
+	labels := make(prometheus.Labels, len(toggles))
+	for _, toggle := range toggles {
+		labels[toggle.name] = strconv.FormatBool(toggle.value)
+	}
+	return labels
+}
+
+// RegisterMetric registers a custom metric at runtime and adds it to the MetricsList. It is safe
+// for concurrent use: if a metric with the same ID was already registered, that metric is
+// returned instead
+func (p *Prometheus) RegisterMetric(m *Metric) (*Metric, error) {
+	p.metricsMu.Lock()
+	defer p.metricsMu.Unlock()
+
+	for _, metricDef := range p.MetricsList {
+		if metricDef.ID == m.ID {
+			return metricDef, nil
+		}
+	}
+
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	metric := NewMetric(metricDefaultsOf(p.config).apply(m), p.subsystem)
+	if err := prometheus.Register(metric); err != nil {
+		return nil, err
+	}
+	m.MetricCollector = metric
+	p.MetricsList = append(p.MetricsList, m)
+	p.runtimeMetrics = append(p.runtimeMetrics, m)
+	return m, nil
+}
+
+// ObserveJob runs fn, a unit of background work such as a queue message, recording its duration
+// into job_duration_seconds and its run into job_runs_total with result "success" or "failure",
+// in the registry of the other metrics. It returns the error of fn
+func (p *Prometheus) ObserveJob(name string, fn func() error) error {
+	durDef, runsDef := *jobDur, *jobRuns
+	dur, err := p.RegisterMetric(&durDef)
+	if err != nil {
+		log.WithError(err).Errorln("Error registering job metrics")
+		return fn()
+	}
+	runs, err := p.RegisterMetric(&runsDef)
+	if err != nil {
+		log.WithError(err).Errorln("Error registering job metrics")
+		return fn()
+	}
+
+	start := time.Now()
+	err = fn()
+	dur.MetricCollector.(*prometheus.HistogramVec).WithLabelValues(name).Observe(time.Since(start).Seconds())
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	runs.MetricCollector.(*prometheus.CounterVec).WithLabelValues(name, result).Inc()
+	return err
+}
+
+// Use adds the middleware to a gin engine.
+func (p *Prometheus) Use(e *gin.Engine) {
+	p.engine = e
+	e.Use(p.HandlerFunc())
+	p.SetMetricsPath(e)
+}
+
+// UseWithAuth adds the middleware to a gin engine with BasicAuth.
+func (p *Prometheus) UseWithAuth(e *gin.Engine, accounts gin.Accounts) {
+	p.engine = e
+	e.Use(p.HandlerFunc())
+	p.SetMetricsPathWithAuth(e, accounts)
+}
+
+// RouteMethods returns the sorted HTTP methods of the routes matching path, e.g. "/users/1" or
+// "/users/:id", of the engine set by Use or UseWithAuth, e.g. for CORS debugging
+func (p *Prometheus) RouteMethods(path string) []string {
+	if p.engine == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var methods []string
+	for _, route := range p.engine.Routes() {
+		if !seen[route.Method] && (route.Path == path || routeMatches(route.Path, path)) {
+			seen[route.Method] = true
+			methods = append(methods, route.Method)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// UseOnGroupWithLabel adds the middleware to a router group, e.g. a mounted sub-application,
+// setting the mount label of its requests to label. It requires Config.MountLabel, and replaces
+// Use for the requests of the group, which would otherwise be recorded twice
+func (p *Prometheus) UseOnGroupWithLabel(rg *gin.RouterGroup, label string) {
+	if !p.config.MountLabel {
+		log.Errorf("mount label %s of group %s requires Config.MountLabel", label, rg.BasePath())
+	}
+	rg.Use(func(c *gin.Context) {
+		c.Set(mountKey, label)
+	}, p.HandlerFunc())
+}
+
+// MarkRateLimited flags the request as rate limited, to be called by a rate limiter middleware
+// before aborting the request. Flagged requests are counted in requests_rate_limited_total
+// when Config.TrackRateLimited is set
+func (p *Prometheus) MarkRateLimited(c *gin.Context) {
+	c.Set(rateLimitedKey, true)
+}
+
+// UseWithRegistry adds the middleware to a gin engine, recording into a separate set of the
+// standard metrics registered in reg, which is exposed on the metrics path of the engine.
+// This allows several engines to share the configuration of one instance while keeping their
+// metrics apart. Custom metrics remain in the default registry.
+//
+// Instances sharing a registry with the same subsystem share its standard metrics, registered
+// once and fed by all of them, which requires the same standard metrics and labels. Otherwise
+// the error is logged and the engine isn't instrumented. ReleaseRegistry undoes UseWithRegistry
+func (p *Prometheus) UseWithRegistry(e *gin.Engine, reg *prometheus.Registry) {
+	metrics, err := p.acquireShared(reg)
+	if err != nil {
+		log.WithError(err).Errorln("Error using registry")
+		return
+	}
+	e.Use(p.handlerFunc(metrics))
+	e.GET(p.MetricsPath, scrapeHandler(func() *metricSet { return metrics }, p.exposition(
+		promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, p.handlerOpts())))))
+}
+
+// sharedKey identifies the standard metrics of a subsystem registered by UseWithRegistry
+type sharedKey struct {
+	reg       *prometheus.Registry
+	subsystem string
+}
+
+// sharedSet is a set of standard metrics shared by the instances using the same sharedKey
+type sharedSet struct {
+	metrics   *metricSet
+	list      []*Metric
+	signature string
+	refs      int
+}
+
+var (
+	sharedSetsMu sync.Mutex
+	sharedSets   = map[sharedKey]*sharedSet{}
+)
+
+// acquireShared returns the standard metrics of the instance registered in reg, registering
+// them on first use
+func (p *Prometheus) acquireShared(reg *prometheus.Registry) (*metricSet, error) {
+	sharedSetsMu.Lock()
+	defer sharedSetsMu.Unlock()
+
+	key := sharedKey{reg, p.subsystem}
+	list := standardMetricsList(p.config)
+	signature := metricsSignature(list)
+	if shared, ok := sharedSets[key]; ok {
+		if shared.signature != signature {
+			return nil, fmt.Errorf("instances sharing a registry with subsystem %q must use the same standard metrics", p.subsystem)
+		}
+		shared.refs++
+		return shared.metrics, nil
+	}
+
+	metrics, err := registerMetrics(list, p.subsystem, reg, metricDefaultsOf(p.config), true, p.config.ReuseExistingCollectors)
+	if err != nil {
+		return nil, err
+	}
+	sharedSets[key] = &sharedSet{metrics: metrics, list: list, signature: signature, refs: 1}
+	return metrics, nil
+}
+
+// ReleaseRegistry releases the standard metrics registered in reg by UseWithRegistry, which
+// are unregistered once released by every instance and engine using them
+func (p *Prometheus) ReleaseRegistry(reg *prometheus.Registry) {
+	sharedSetsMu.Lock()
+	defer sharedSetsMu.Unlock()
+
+	key := sharedKey{reg, p.subsystem}
+	shared, ok := sharedSets[key]
+	if !ok {
+		return
+	}
+	if shared.refs--; shared.refs == 0 {
+		for _, metricDef := range shared.list {
+			if !metricDef.adopted {
+				reg.Unregister(metricDef.MetricCollector)
+			}
+		}
+		delete(sharedSets, key)
+	}
+}
+
+// metricsSignature describes the series of the metrics, to check that shared metrics are
+// recorded with the same labels
+func metricsSignature(list []*Metric) string {
+	var b strings.Builder
+	for _, m := range list {
+		fmt.Fprintf(&b, "%s %s %v %v;", m.Name, m.Type, m.Args, m.Buckets)
+	}
+	return b.String()
+}
+
+// HandlerFunc defines handler function for middleware
 func (p *Prometheus) HandlerFunc() gin.HandlerFunc {
+	return p.handlerFunc(nil)
+}
+
+// handlerFunc returns the middleware recording into metrics, or into the default set of the
+// instance, which Reconfigure may replace, if nil
+func (p *Prometheus) handlerFunc(metrics *metricSet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p.instrument(metrics, c, c.Next, true)
+	}
+}
+
+// Instrumented wraps a single handler with the middleware, for instrumenting selected routes
+// instead of the whole engine, e.g. r.GET("/x", p.Instrumented(xHandler))
+func (p *Prometheus) Instrumented(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p.instrument(nil, c, func() { handler(c) }, false)
+	}
+}
+
+// TimeStage wraps a handler of the middleware chain, observing its duration into
+// middleware_stage_duration_seconds with the stage label, e.g. to find where the time of
+// requests goes. The duration of a middleware calling c.Next() includes the rest of the chain.
+// The handler is returned unwrapped unless Config.EnableStageTiming is set
+func (p *Prometheus) TimeStage(stage string, h gin.HandlerFunc) gin.HandlerFunc {
+	if !p.config.EnableStageTiming {
+		return h
+	}
+	return func(c *gin.Context) {
+		start := time.Now()
+		h(c)
+		elapsed := float64(time.Since(start)) / float64(time.Second)
+
+		p.reconfigMu.RLock()
+		defer p.reconfigMu.RUnlock()
+		if p.metrics.stageDur != nil {
+			p.metrics.stageDur.WithLabelValues(stage).Observe(elapsed)
+		}
+	}
+}
+
+// instrument records the metrics of the request handled by next into metrics, or the default
+// set of the instance if nil, unless skipIgnored is set and the request is ignored. The
+// configuration isn't locked while next runs, so that Reconfigure doesn't wait for in-flight
+// requests, which are recorded with the configuration at their end. Exemplars are built before
+// the configuration is locked again, from the one at the start of the request
+func (p *Prometheus) instrument(metrics *metricSet, c *gin.Context, next func(), skipIgnored bool) {
+	p.reconfigMu.RLock()
+	if skipIgnored && p.ignored(c) {
+		p.reconfigMu.RUnlock()
+		next()
+		return
+	}
+	exemplarFn, requestIDHeader, responseHeaders := p.config.ExemplarFromContext, p.config.RequestIDHeader, p.config.ExemplarResponseHeaders
+	entry := metrics
+	if entry == nil {
+		entry = p.metrics
+	}
+	if entry.concurrency != nil {
+		entry.concurrency.Observe(float64(atomic.AddInt64(&entry.inFlight, 1)))
+		defer atomic.AddInt64(&entry.inFlight, -1)
+	}
+
+	start := time.Now()
+	reqSz, maxHeader := computeApproximateRequestSize(c.Request)
+
+	var body *timedReadCloser
+	if p.config.ExcludeBodyReadFromDuration && c.Request.Body != nil {
+		body = &timedReadCloser{ReadCloser: c.Request.Body}
+		c.Request.Body = body
+	}
+	var failing *failingReadCloser
+	if p.config.TrackBodyReadErrors && c.Request.Body != nil {
+		failing = &failingReadCloser{ReadCloser: c.Request.Body}
+		c.Request.Body = failing
+	}
+	var writer *timingWriter
+	if p.config.TrackRenderTime || p.config.TrackBodyWriteDuration || p.config.ExcludeClientWriteTime {
+		writer = &timingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+	}
+	var hijack *hijackWriter
+	if p.config.TrackWebSocketUpgrades {
+		hijack = &hijackWriter{ResponseWriter: c.Writer}
+		c.Writer = hijack
+	}
+	var interim *informationalWriter
+	if p.config.Track1xx {
+		interim = &informationalWriter{ResponseWriter: c.Writer}
+		c.Writer = interim
+	}
+	var failedWrites *failingWriter
+	if p.config.TrackRenderErrors {
+		failedWrites = &failingWriter{ResponseWriter: c.Writer}
+		c.Writer = failedWrites
+	}
+	overhead := time.Since(start)
+	p.reconfigMu.RUnlock()
+
+	next()
+
+	exemplar := requestExemplar(c, exemplarFn, requestIDHeader, responseHeaders)
+	p.reconfigMu.RLock()
+	defer p.reconfigMu.RUnlock()
+	if metrics == nil {
+		metrics = p.metrics
+		if p.config.SubsystemFn != nil {
+			if set, ok := p.subsystemSets[p.config.SubsystemFn(c)]; ok {
+				metrics = set
+			}
+		}
+	}
+	recordStart := time.Now()
+	statusCode := p.statusCode(c)
+	status := strconv.Itoa(statusCode)
+	duration := time.Since(start)
+	if body != nil {
+		duration -= body.elapsed
+	}
+	if p.config.ExcludeClientWriteTime && writer != nil && !writer.lastWrite.IsZero() {
+		duration -= recordStart.Sub(writer.lastWrite) + writer.writing
+	}
+	if duration < 0 {
+		// e.g. a clock adjustment, negative observations would be meaningless. Logged once, as
+		// every request may be clamped until the clock settles
+		p.clampOnce.Do(func() {
+			log.Warnf("Clamping negative request duration %s to 0, further ones aren't logged", duration)
+		})
+		duration = 0
+	}
+	elapsed := float64(duration) / float64(time.Second)
+	// the size is -1 if no body was written
+	resSz := math.Max(float64(c.Writer.Size()), 0)
+	if p.config.HeadUsesContentLength && c.Request.Method == http.MethodHead {
+		if length, err := strconv.ParseInt(c.Writer.Header().Get("Content-Length"), 10, 64); err == nil && length >= 0 {
+			resSz = float64(length)
+		}
+	}
+
+	url := p.urlLabel(c)
+	if fn := p.config.ReqCntURLLabelMappingFnWithStatus; fn != nil {
+		url = fn(c, statusCode)
+	}
+	if p.config.CanonicalEndpoint {
+		url = c.FullPath()
+	}
+	// jlambert Oct 2018 - sidecar specific mod
+	if len(p.URLLabelFromContext) > 0 {
+		url = "unknown"
+		if u, found := c.Get(p.URLLabelFromContext); found {
+			if s, ok := u.(string); ok {
+				url = s
+			}
+		}
+	}
+	if p.config.OperationNameContextKey != "" {
+		if op, found := c.Get(p.config.OperationNameContextKey); found {
+			if s, ok := op.(string); ok && s != "" {
+				url = s
+			}
+		}
+	}
+	for _, replacement := range p.config.URLReplacements {
+		url = replacement.Pattern.ReplaceAllString(url, replacement.Replacement)
+	}
+	if p.staticRoute(c) {
+		url = p.config.StaticRouteLabel
+	}
+	if !p.urlLabelMethod(c.Request.Method) {
+		url = AggregatedURLLabel
+	}
+	url = p.truncateLabel(url)
+	if p.config.MaxURLCardinality > 0 {
+		if url = metrics.urls.bound(url, p.config.MaxURLCardinality, OverBudgetURLLabel); url == OverBudgetURLLabel {
+			metrics.budgetOnce.Do(func() {
+				log.Warnf("More than %d distinct url labels, new ones are recorded as %s", p.config.MaxURLCardinality, OverBudgetURLLabel)
+				metrics.budgetExceeded.Set(1)
+			})
+		}
+	}
+	// label values are ordered as the args cached at registration, sized up front so that
+	// the optional labels below don't reallocate
+	durKey := url
+	if p.config.DurationByHandler {
+		durKey = p.handlerLabel(c)
+	}
+	durLabels := append(make([]string, 0, len(metrics.durArgs)), status, c.Request.Method, durKey)
+	durLabels = appendCustomLabels(durLabels, p.customDurLabels, c)
+	cntLabels := append(make([]string, 0, len(metrics.cntArgs)),
+		status, c.Request.Method, p.handlerLabel(c), p.hostLabel(c), url)
+	if p.config.RoleFn != nil {
+		cntLabels = append(cntLabels, p.config.RoleFn(c))
+	}
+	if p.config.MountLabel {
+		cntLabels = append(cntLabels, c.GetString(mountKey))
+	}
+	if len(p.config.RouteLabels) > 0 {
+		cntLabels = append(cntLabels, p.routeLabels(c)...)
+	}
+	if p.config.TrackRequestContentType {
+		cntLabels = append(cntLabels, metrics.contentType(c.GetHeader("Content-Type")))
+	}
+	if p.config.DualURLLabels {
+		if !p.config.CanonicalEndpoint {
+			cntLabels = append(cntLabels, c.FullPath())
+		}
+		cntLabels = append(cntLabels, metrics.rawPaths.bound(c.Request.URL.Path, maxRawPaths, "other"))
+	}
+	cntLabels = appendCustomLabels(cntLabels, p.customLabels, c)
+	if p.config.CacheHitContextKey != "" {
+		cache := "miss"
+		if c.GetBool(p.config.CacheHitContextKey) {
+			cache = "hit"
+		}
+		cntLabels = append(cntLabels, cache)
+	}
+	if p.config.LabelHook != nil {
+		cntLabels = p.applyLabelHook(c, metrics.cntArgs, cntLabels)
+		durLabels = p.applyLabelHook(c, metrics.durArgs, durLabels)
+	}
+	if len(p.allowlists) > 0 {
+		p.applyAllowlists(metrics.cntArgs, cntLabels)
+		p.applyAllowlists(metrics.durArgs, durLabels)
+	}
+	if p.config.MaxLabelValueLength > 0 {
+		for i := range cntLabels {
+			cntLabels[i] = p.truncateLabel(cntLabels[i])
+		}
+		for i := range durLabels {
+			durLabels[i] = p.truncateLabel(durLabels[i])
+		}
+	}
+	upgraded := metrics.wsUpgrades != nil && (statusCode == http.StatusSwitchingProtocols || hijack != nil && hijack.hijacked)
+	method := c.Request.Method
+	skipZero, minSize, diagnosticHeaders := p.config.SkipZeroDuration, p.config.MinSizeToObserve, p.config.DiagnosticHeaders
+	sampledOut := p.config.SampleSuccesses && statusCode/100 == 2 && rand.Float64() >= p.config.SampleSuccessRate
+	var header http.Header
+	if metrics.headerCard != nil {
+		header = c.Request.Header
+	}
+	var retryAfterValue string
+	if metrics.retryAfter != nil && statusCode == http.StatusTooManyRequests {
+		retryAfterValue = c.Writer.Header().Get("Retry-After")
+	}
+	upstream, upstreamOK := 0.0, false
+	if metrics.upstreamDur != nil {
+		upstream, upstreamOK = parseUpstreamTime(c.Writer.Header().Get(p.config.UpstreamTimeHeader))
+	}
+	contextValue, contextValueOK := 0.0, false
+	if metrics.contextGauge != nil {
+		if v, found := c.Get(p.config.ContextValueGauge.Key); found {
+			contextValue, contextValueOK = toFloat(v)
+		}
+	}
+	renderError := metrics.renderErrors != nil && failedWrites != nil && failedWrites.failed
+	rateLimited := metrics.reqLimited != nil && c.GetBool(rateLimitedKey)
+	bodyReadError := metrics.bodyReadErrors != nil && failing != nil && failing.failed
+	var informationalCodes []int
+	if metrics.informational != nil && interim != nil {
+		informationalCodes = interim.codes
+	}
+	var renderElapsed, bodyWriteElapsed time.Duration
+	if metrics.renderDur != nil && writer != nil && !writer.firstWrite.IsZero() {
+		renderElapsed = recordStart.Sub(writer.firstWrite)
+	}
+	if metrics.bodyWriteDur != nil && writer != nil && !writer.headerWrite.IsZero() {
+		bodyWriteElapsed = recordStart.Sub(writer.headerWrite)
+	}
+
+	// record only uses values computed above, so that it can run after the request is done
+	record := func() {
+		if upgraded {
+			metrics.wsUpgrades.WithLabelValues(url).Inc()
+		} else if (elapsed > 0 || !skipZero) && !sampledOut {
+			metrics.observeDuration(method, durLabels, elapsed, exemplar)
+		}
+		metrics.reqCnt.WithLabelValues(cntLabels...).Inc()
+		if metrics.reqCntLow != nil {
+			metrics.reqCntLow.WithLabelValues(strconv.Itoa(statusCode/100)+"xx", method).Inc()
+		}
+		if metrics.reqServed != nil {
+			metrics.reqServed.Inc()
+		}
+		if renderElapsed > 0 {
+			metrics.renderDur.WithLabelValues(url).Observe(float64(renderElapsed) / float64(time.Second))
+		}
+		if bodyWriteElapsed > 0 {
+			metrics.bodyWriteDur.WithLabelValues(url).Observe(float64(bodyWriteElapsed) / float64(time.Second))
+		}
+		if header != nil {
+			metrics.trackHeaders(header, diagnosticHeaders)
+		}
+		if metrics.coldStart != nil {
+			metrics.coldOnce.Do(func() {
+				metrics.coldStart.Set(elapsed)
+			})
+		}
+		if reqSz >= minSize {
+			metrics.reqSz.Observe(float64(reqSz))
+		}
+		if !upgraded && resSz >= float64(minSize) {
+			metrics.resSz.Observe(resSz)
+		}
+		if retryAfterValue != "" {
+			if delay, ok := parseRetryAfter(retryAfterValue, recordStart); ok {
+				metrics.retryAfter.Observe(delay.Seconds())
+			}
+		}
+		if upstreamOK {
+			metrics.upstreamDur.Observe(upstream)
+		}
+		if metrics.maxHeaderSz != nil {
+			metrics.maxHeaderSz.Observe(float64(maxHeader))
+		}
+		if contextValueOK {
+			metrics.contextGauge.Set(contextValue)
+		}
+		if renderError {
+			metrics.renderErrors.WithLabelValues(url).Inc()
+		}
+		if bodyReadError {
+			metrics.bodyReadErrors.WithLabelValues(url).Inc()
+		}
+		for _, code := range informationalCodes {
+			metrics.informational.WithLabelValues(strconv.Itoa(code)).Inc()
+		}
+		if rateLimited {
+			metrics.reqLimited.WithLabelValues(url).Inc()
+		}
+	}
+	if p.recordings != nil {
+		p.enqueue(metrics, record)
+	} else {
+		record()
+	}
+
+	if metrics.overhead != nil {
+		overhead += time.Since(recordStart)
+		metrics.overhead.Observe(float64(overhead) / float64(time.Second))
+	}
+}
+
+// enqueue queues the recording of a request for the background recorder enabled by
+// Config.AsyncBufferSize, applying Config.DropPolicy when the buffer is full
+func (p *Prometheus) enqueue(metrics *metricSet, record func()) {
+	select {
+	case p.recordings <- record:
+		return
+	default:
+	}
+
+	switch p.config.DropPolicy {
+	case Block:
+		p.recordings <- record
+		return
+	case DropOldest:
+		select {
+		case <-p.recordings:
+			metrics.dropped.Inc()
+		default:
+		}
+		select {
+		case p.recordings <- record:
+			return
+		default:
+		}
+	}
+	metrics.dropped.Inc()
+}
+
+// startRecorder starts the background recorder enabled by Config.AsyncBufferSize
+func (p *Prometheus) startRecorder() {
+	p.recordings = make(chan func(), p.config.AsyncBufferSize)
+	p.recorderDone = make(chan struct{})
+	go func(recordings <-chan func(), done chan<- struct{}) {
+		defer close(done)
+		for record := range recordings {
+			recordSafely(record)
+		}
+	}(p.recordings, p.recorderDone)
+}
+
+// recordSafely runs a queued recording, logging its panic, e.g. an invalid label value, which
+// would otherwise kill the process since no gin.Recovery wraps the recorder
+func recordSafely(record func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("Recording a request panicked: %v", err)
+		}
+	}()
+	record()
+}
+
+// stopRecorder stops the background recorder enabled by Config.AsyncBufferSize once it has
+// recorded the queued requests, or ctx is done. Requests are recorded synchronously afterwards
+func (p *Prometheus) stopRecorder(ctx context.Context) error {
+	p.reconfigMu.Lock()
+	recordings, done := p.recordings, p.recorderDone
+	p.recordings, p.recorderDone = nil, nil
+	p.reconfigMu.Unlock()
+	if recordings == nil {
+		return nil
+	}
+	close(recordings)
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// routeLabels returns the values of Config.RouteLabels for the route of the request, in the
+// order of their sorted keys. Exact templates take precedence over the longest matching prefix
+func (p *Prometheus) routeLabels(c *gin.Context) []string {
+	fullPath := c.FullPath()
+	labels, ok := p.config.RouteLabels[fullPath]
+	if !ok {
+		prefixLen := 0
+		for template, l := range p.config.RouteLabels {
+			prefix := strings.TrimSuffix(template, "*")
+			if prefix != template && len(prefix) > prefixLen && strings.HasPrefix(fullPath, prefix) {
+				labels, prefixLen = l, len(prefix)
+			}
+		}
+	}
+
+	values := make([]string, len(p.routeKeys))
+	for i, key := range p.routeKeys {
+		values[i] = labels[key]
+	}
+	return values
+}
+
+// urlLabelMethod reports whether requests with the method keep their url label
+func (p *Prometheus) urlLabelMethod(method string) bool {
+	if len(p.config.URLLabelMethods) == 0 {
+		return true
+	}
+	for _, m := range p.config.URLLabelMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelEllipsis marks label values truncated by Config.MaxLabelValueLength
+const labelEllipsis = "..."
+
+// truncateLabel caps value to Config.MaxLabelValueLength runes, ellipsis included
+func (p *Prometheus) truncateLabel(value string) string {
+	max := p.config.MaxLabelValueLength
+	if max <= 0 || utf8.RuneCountInString(value) <= max {
+		return value
+	}
+	if max <= len(labelEllipsis) {
+		return string([]rune(value)[:max])
+	}
+	return string([]rune(value)[:max-len(labelEllipsis)]) + labelEllipsis
+}
+
+// hostLabel returns the host of the request, from X-Forwarded-Host if
+// Config.TrustForwardedHeaders is set
+func (p *Prometheus) hostLabel(c *gin.Context) string {
+	if p.config.TrustForwardedHeaders {
+		// the first host is the one of the client when several proxies appended theirs
+		if host := strings.TrimSpace(strings.SplitN(c.GetHeader("X-Forwarded-Host"), ",", 2)[0]); host != "" {
+			return host
+		}
+	}
+	return c.Request.Host
+}
+
+// staticRoute reports whether Config.StaticRouteLabel applies to the request, served by the
+// static file handler of gin
+func (p *Prometheus) staticRoute(c *gin.Context) bool {
+	return p.config.StaticRouteLabel != "" && strings.Contains(c.HandlerName(), "createStaticHandler")
+}
+
+// handlerLabel returns the handler label selected by Config.HandlerLabelFromRoute
+func (p *Prometheus) handlerLabel(c *gin.Context) string {
+	if p.staticRoute(c) {
+		return p.config.StaticRouteLabel
+	}
+	if p.config.HandlerLabelFromRoute {
+		return c.FullPath()
+	}
+	return c.HandlerName()
+}
+
+// urlLabel maps the url label with the function set for the route by SetURLMapping, if any,
+// or ReqCntURLLabelMappingFn
+func (p *Prometheus) urlLabel(c *gin.Context) string {
+	p.urlMappingsMu.RLock()
+	fn, ok := p.urlMappings[c.FullPath()]
+	p.urlMappingsMu.RUnlock()
+	if ok {
+		return fn(c)
+	}
+	return p.ReqCntURLLabelMappingFn(c)
+}
+
+// observeDuration observes the request duration into the histogram(s) enabled by the Config
+func (m *metricSet) observeDuration(method string, labels []string, elapsed float64, exemplar prometheus.Labels) {
+	if m.reqDur != nil {
+		observe(m.reqDur.WithLabelValues(labels...), elapsed, exemplar)
+	}
+	if m.reqDurFast != nil {
+		if elapsed < splitDurationThreshold {
+			observe(m.reqDurFast.WithLabelValues(labels...), elapsed, exemplar)
+		} else {
+			observe(m.reqDurSlow.WithLabelValues(labels...), elapsed, exemplar)
+		}
+	}
+	if m.reqDurSummary != nil {
+		m.reqDurSummary.WithLabelValues(labels...).Observe(elapsed)
+	}
+	if m.reqDurRead != nil {
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			observe(m.reqDurRead.WithLabelValues(labels...), elapsed, exemplar)
+		default:
+			observe(m.reqDurWrite.WithLabelValues(labels...), elapsed, exemplar)
+		}
+	}
+}
+
+// contentType returns the request_content_type label of a Content-Type header: its lower case
+// media type without parameters, "none" if empty, or "other" past maxContentTypes values
+func (m *metricSet) contentType(header string) string {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(header, ";", 2)[0]))
+	if mediaType == "" {
+		return "none"
+	}
+
+	return m.contentTypes.bound(mediaType, maxContentTypes, "other")
+}
+
+// boundedSet bounds the distinct values of a label
+type boundedSet struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// bound returns value if it is one of the first max distinct values seen, or overflow
+func (b *boundedSet) bound(value string, max int, overflow string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.seen[value]; ok {
+		return value
+	}
+	if b.seen == nil {
+		b.seen = map[string]struct{}{}
+	}
+	if len(b.seen) >= max {
+		return overflow
+	}
+	b.seen[value] = struct{}{}
+	return value
+}
+
+// trackHeaders adds the values of the diagnostic headers to their sets of distinct values
+func (m *metricSet) trackHeaders(header http.Header, names []string) {
+	m.headerMu.Lock()
+	defer m.headerMu.Unlock()
+
+	for _, name := range names {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		seen, ok := m.headerSeen[name]
+		if !ok {
+			seen = map[uint64]struct{}{}
+			m.headerSeen[name] = seen
+		}
+		if len(seen) >= maxHeaderCardinality {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(value))
+		seen[h.Sum64()] = struct{}{}
+		m.headerCard.WithLabelValues(name).Set(float64(len(seen)))
+	}
+}
+
+// observe observes the value with the exemplar, if any
+func observe(o prometheus.Observer, value float64, exemplar prometheus.Labels) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && len(exemplar) > 0 {
+		eo.ObserveWithExemplar(value, exemplar)
+		return
+	}
+	o.Observe(value)
+}
+
+// maxExemplarRunes is the maximum combined length of the names and values of exemplar labels
+const maxExemplarRunes = 128
+
+// requestExemplar returns the exemplar labels of the request from the exemplar options of the
+// Config, if any. The map is only allocated once a label is found. The labels of fromContext and
+// the request id are dropped if longer than allowed by OpenMetrics
+func requestExemplar(c *gin.Context, fromContext ExemplarFromContextFn, requestIDHeader string, responseHeaders []string) prometheus.Labels {
+	var labels prometheus.Labels
+	if fromContext != nil {
+		if fromCtx := fromContext(c); len(fromCtx) > 0 {
+			labels = make(prometheus.Labels, len(fromCtx)+1)
+			for name, value := range fromCtx {
+				labels[name] = value
+			}
+		}
+	}
+	if requestIDHeader != "" {
+		// the header comes from the client, and invalid UTF-8 would make the observation panic
+		if id := c.GetHeader(requestIDHeader); id != "" && utf8.ValidString(id) {
+			if labels == nil {
+				labels = make(prometheus.Labels, 1)
+			}
+			labels["request_id"] = id
+		}
+	}
+
+	runes := 0
+	for name, value := range labels {
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	if runes > maxExemplarRunes {
+		labels, runes = nil, 0
+	}
+	for _, header := range responseHeaders {
+		value := c.Writer.Header().Get(header)
+		if value == "" || !utf8.ValidString(value) {
+			continue
+		}
+		name := exemplarLabelName(header)
+		if _, ok := labels[name]; ok {
+			continue
+		}
+		if n := utf8.RuneCountInString(name) + utf8.RuneCountInString(value); runes+n <= maxExemplarRunes {
+			if labels == nil {
+				labels = make(prometheus.Labels, 1)
+			}
+			labels[name] = value
+			runes += n
+		}
+	}
+	return labels
+}
+
+// exemplarLabelName returns the exemplar label name of a header of
+// Config.ExemplarResponseHeaders, e.g. x_request_id for X-Request-Id
+func exemplarLabelName(header string) string {
+	return strings.ToLower(strings.ReplaceAll(header, "-", "_"))
+}
+
+// validLabelName reports whether name matches [a-zA-Z_][a-zA-Z0-9_]* and isn't reserved
+func validLabelName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "__") {
+		return false
+	}
+	for i, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// exemplarsEnabled reports whether exemplars are recorded, and thus OpenMetrics exposed
+func (p *Prometheus) exemplarsEnabled() bool {
+	return p.config.RequestIDHeader != "" || p.config.ExemplarFromContext != nil || len(p.config.ExemplarResponseHeaders) > 0
+}
+
+// statusCode returns the status of the response, or Config.DefaultStatusCode if none was set
+func (p *Prometheus) statusCode(c *gin.Context) int {
+	code := c.Writer.Status()
+	if code/100 == 1 && code != http.StatusSwitchingProtocols {
+		// net/http follows an informational status not followed by a final one with a 200
+		code = http.StatusOK
+	}
+	if code == 0 && p.config.DefaultStatusCode != 0 {
+		return p.config.DefaultStatusCode
+	}
+	return code
+}
+
+// ignored reports whether the request must not be recorded: requests to the metrics paths,
+// and to the paths and with the methods ignored by the Config
+func (p *Prometheus) ignored(c *gin.Context) bool {
+	path := p.requestPath(c)
+	if path == p.MetricsPath || (path != "" && (path == p.config.JSONMetricsPath || path == p.config.DashboardPath)) {
+		return true
+	}
+	for _, ignored := range p.config.IgnorePaths {
+		if path == ignored {
+			return true
+		}
+	}
+	for _, ignored := range p.config.IgnoreMethods {
+		if c.Request.Method == ignored {
+			return true
+		}
+	}
+	return false
+}
+
+// requestPath returns the path of the request selected by Config.PathSource
+func (p *Prometheus) requestPath(c *gin.Context) string {
+	if p.config.PathSource == FullPath {
+		return c.FullPath()
+	}
+	return c.Request.URL.Path
+}
+
+// defaultURLLabel is the default ReqCntURLLabelMappingFn, returning the path selected by
+// Config.PathSource as is, except for catch-all routes, e.g. "/files/*filepath", for which the
+// route template is returned as their paths are unbounded
+func (p *Prometheus) defaultURLLabel(c *gin.Context) string {
+	fullPath := c.FullPath()
+	for _, param := range c.Params {
+		if strings.HasSuffix(fullPath, "/*"+param.Key) {
+			return fullPath
+		}
+	}
+	return p.requestPath(c)
+}
+
+// applyLabelHook passes the label values, in the order of names, through Config.LabelHook
+func (p *Prometheus) applyLabelHook(c *gin.Context, names, values []string) []string {
+	labels := make(prometheus.Labels, len(names))
+	for i, name := range names {
+		labels[name] = values[i]
+	}
+
+	p.config.LabelHook(c, labels)
+
+	for i, name := range names {
+		if v, ok := labels[name]; ok {
+			values[i] = v
+		}
+	}
+	return values
+}
+
+// labelAllowlists returns the sets of allowed values of Config.LabelValueAllowlists
+func labelAllowlists(cfg Config) map[string]map[string]bool {
+	allowlists := make(map[string]map[string]bool, len(cfg.LabelValueAllowlists))
+	for name, values := range cfg.LabelValueAllowlists {
+		allowed := make(map[string]bool, len(values))
+		for _, value := range values {
+			allowed[value] = true
+		}
+		allowlists[name] = allowed
+	}
+	return allowlists
+}
+
+// applyAllowlists replaces the label values, in the order of names, missing from their
+// allowlist by OtherLabelValue
+func (p *Prometheus) applyAllowlists(names, values []string) {
+	for i, name := range names {
+		if allowed, ok := p.allowlists[name]; ok && !allowed[values[i]] {
+			values[i] = OtherLabelValue
+		}
+	}
+}
+
+// jsonSummary is the body served on Config.JSONMetricsPath
+type jsonSummary struct {
+	RequestsTotal uint64            `json:"requests_total"`
+	ByStatus      map[string]uint64 `json:"by_status"`
+}
+
+func (p *Prometheus) jsonMetricsHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if c.Request.URL.Path == p.MetricsPath {
-			c.Next()
+		name := prometheus.BuildFQName("", p.currentSubsystem(), reqCnt.Name)
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		start := time.Now()
-		reqSz := computeApproximateRequestSize(c.Request)
+		summary := jsonSummary{ByStatus: map[string]uint64{}}
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				v := uint64(m.GetCounter().GetValue())
+				summary.RequestsTotal += v
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "code" {
+						summary.ByStatus[l.GetValue()] += v
+					}
+				}
+			}
+		}
+		c.JSON(http.StatusOK, summary)
+	}
+}
+
+// dashboardRow is a url of the page served on Config.DashboardPath
+type dashboardRow struct {
+	URL           string
+	Requests      uint64
+	ErrorRate     float64
+	P50, P90, P99 string
+	buckets       map[float64]uint64
+}
 
-		c.Next()
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<table border="1">
+<tr><th>url</th><th>requests</th><th>5xx rate</th><th>p50</th><th>p90</th><th>p99</th></tr>
+{{range .Rows}}<tr><td>{{.URL}}</td><td>{{.Requests}}</td><td>{{printf "%.2f%%" .ErrorRate}}</td><td>{{.P50}}</td><td>{{.P90}}</td><td>{{.P99}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
 
-		status := strconv.Itoa(c.Writer.Status())
-		elapsed := float64(time.Since(start)) / float64(time.Second)
-		resSz := float64(c.Writer.Size())
+func (p *Prometheus) dashboardHandler() gin.HandlerFunc {
+	cntName := prometheus.BuildFQName("", p.subsystem, reqCnt.Name)
+	durName := prometheus.BuildFQName("", p.subsystem, reqDur.Name)
+	return func(c *gin.Context) {
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Error gathering metrics: %s", err)
+			return
+		}
+
+		rows := map[string]*dashboardRow{}
+		row := func(m *dto.Metric) *dashboardRow {
+			url := labelValue(m, "url", "route")
+			if rows[url] == nil {
+				rows[url] = &dashboardRow{URL: url, buckets: map[float64]uint64{}}
+			}
+			return rows[url]
+		}
+		failures := map[string]uint64{}
+		for _, family := range families {
+			switch family.GetName() {
+			case cntName:
+				for _, m := range family.GetMetric() {
+					r := row(m)
+					v := uint64(m.GetCounter().GetValue())
+					r.Requests += v
+					if strings.HasPrefix(labelValue(m, "code"), "5") {
+						failures[r.URL] += v
+					}
+				}
+			case durName:
+				for _, m := range family.GetMetric() {
+					r := row(m)
+					for _, b := range m.GetHistogram().GetBucket() {
+						r.buckets[b.GetUpperBound()] += b.GetCumulativeCount()
+					}
+					r.buckets[math.Inf(1)] += m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+
+		sorted := make([]*dashboardRow, 0, len(rows))
+		for _, r := range rows {
+			if r.Requests > 0 {
+				r.ErrorRate = 100 * float64(failures[r.URL]) / float64(r.Requests)
+			}
+			r.P50, r.P90, r.P99 = bucketQuantile(r.buckets, 0.5), bucketQuantile(r.buckets, 0.9), bucketQuantile(r.buckets, 0.99)
+			sorted = append(sorted, r)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].URL < sorted[j].URL })
+
+		var buf bytes.Buffer
+		data := struct {
+			Title string
+			Rows  []*dashboardRow
+		}{p.subsystem + " metrics", sorted}
+		if err := dashboardTemplate.Execute(&buf, data); err != nil {
+			c.String(http.StatusInternalServerError, "Error rendering dashboard: %s", err)
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+	}
+}
+
+// labelValue returns the value of the first of the labels present on m
+func labelValue(m *dto.Metric, names ...string) string {
+	for _, name := range names {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == name {
+				return l.GetValue()
+			}
+		}
+	}
+	return ""
+}
+
+// bucketQuantile estimates the quantile q of the cumulative histogram buckets, interpolating
+// linearly within the bucket it falls in, or returns "-" without observations
+func bucketQuantile(buckets map[float64]uint64, q float64) string {
+	bounds := make([]float64, 0, len(buckets))
+	for bound := range buckets {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	if len(bounds) == 0 || buckets[bounds[len(bounds)-1]] == 0 {
+		return "-"
+	}
 
-		url := p.ReqCntURLLabelMappingFn(c)
-		// jlambert Oct 2018 - sidecar specific mod
-		if len(p.URLLabelFromContext) > 0 {
-			u, found := c.Get(p.URLLabelFromContext)
-			if !found {
-				u = "unknown"
+	rank := q * float64(buckets[bounds[len(bounds)-1]])
+	lower, lowerCount := 0.0, 0.0
+	for _, bound := range bounds {
+		count := float64(buckets[bound])
+		if count >= rank {
+			if math.IsInf(bound, 1) {
+				bound = lower
+			} else if count > lowerCount {
+				bound = lower + (bound-lower)*(rank-lowerCount)/(count-lowerCount)
 			}
-			url = u.(string)
+			return time.Duration(bound * float64(time.Second)).Round(time.Microsecond).String()
 		}
-		p.reqDur.WithLabelValues(status, c.Request.Method, url).Observe(elapsed)
-		p.reqCnt.WithLabelValues(status, c.Request.Method, c.HandlerName(), c.Request.Host, url).Inc()
-		p.reqSz.Observe(float64(reqSz))
-		p.resSz.Observe(resSz)
+		lower, lowerCount = bound, count
+	}
+	return "-"
+}
+
+func (p *Prometheus) prometheusHandler() gin.HandlerFunc {
+	return scrapeHandler(p.currentMetrics, p.exposition(promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, p.handlerOpts()))))
+}
+
+// currentSubsystem returns the subsystem of the instance, which Reconfigure may change
+func (p *Prometheus) currentSubsystem() string {
+	p.reconfigMu.RLock()
+	defer p.reconfigMu.RUnlock()
+	return p.subsystem
+}
+
+// currentMetrics returns the standard metrics of the default registry, which Reconfigure may
+// replace
+func (p *Prometheus) currentMetrics() *metricSet {
+	p.reconfigMu.RLock()
+	defer p.reconfigMu.RUnlock()
+	return p.metrics
+}
+
+func (p *Prometheus) handlerOpts() promhttp.HandlerOpts {
+	return promhttp.HandlerOpts{EnableOpenMetrics: p.exemplarsEnabled()}
+}
+
+// exposition forces the format of the metrics served by h according to Config.ExpositionFormat
+func (p *Prometheus) exposition(h http.Handler) http.Handler {
+	if p.config.ExpositionFormat != ProtobufFormat {
+		return h
 	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+		h.ServeHTTP(w, r)
+	})
 }
 
-func prometheusHandler() gin.HandlerFunc {
-	h := promhttp.Handler()
+// scrapeHandler serves the metrics with h, observing the scrape duration into the set returned
+// by metrics if enabled
+func scrapeHandler(metrics func() *metricSet, h http.Handler) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		start := time.Now()
 		h.ServeHTTP(c.Writer, c.Request)
+		if m := metrics(); m.scrapeDur != nil {
+			m.scrapeDur.Observe(float64(time.Since(start)) / float64(time.Second))
+		}
+	}
+}
+
+// timedReadCloser wraps a request body and accumulates the time spent reading it
+type timedReadCloser struct {
+	io.ReadCloser
+	elapsed time.Duration
+}
+
+func (r *timedReadCloser) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := r.ReadCloser.Read(b)
+	r.elapsed += time.Since(start)
+	return n, err
+}
+
+// failingReadCloser wraps a request body and records whether reading or closing it failed
+type failingReadCloser struct {
+	io.ReadCloser
+	failed bool
+}
+
+func (r *failingReadCloser) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if err != nil && err != io.EOF {
+		r.failed = true
 	}
+	return n, err
 }
 
-// From https://github.com/DanielHeckrath/gin-prometheus/blob/master/gin_prometheus.go
-func computeApproximateRequestSize(r *http.Request) int {
+func (r *failingReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	if err != nil {
+		r.failed = true
+	}
+	return err
+}
+
+// timingWriter wraps a gin.ResponseWriter and records when the response header and body are
+// first written, when the body is last written and the time spent blocked in writes
+type timingWriter struct {
+	gin.ResponseWriter
+	headerWrite time.Time
+	firstWrite  time.Time
+	lastWrite   time.Time
+	writing     time.Duration
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	w.wroteHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) WriteHeaderNow() {
+	w.wroteHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	w.wrote()
+	n, err := w.ResponseWriter.Write(b)
+	w.written()
+	return n, err
+}
+
+func (w *timingWriter) WriteString(s string) (int, error) {
+	w.wrote()
+	n, err := w.ResponseWriter.WriteString(s)
+	w.written()
+	return n, err
+}
+
+func (w *timingWriter) wroteHeader() {
+	if w.headerWrite.IsZero() {
+		w.headerWrite = time.Now()
+	}
+}
+
+func (w *timingWriter) wrote() {
+	if w.firstWrite.IsZero() {
+		w.firstWrite = time.Now()
+	}
+	if w.headerWrite.IsZero() {
+		w.headerWrite = w.firstWrite
+	}
+	w.lastWrite = time.Now()
+}
+
+// written adds the time blocked in the write started at lastWrite
+func (w *timingWriter) written() {
+	w.writing += time.Since(w.lastWrite)
+	w.lastWrite = time.Now()
+}
+
+// parseRetryAfter parses a Retry-After header value, either delay seconds or an HTTP date
+// relative to now
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
+// toFloat converts a numeric value to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// parseUpstreamTime parses an upstream response time header value in seconds, summing the
+// comma separated times of several upstreams, e.g. "0.012, 0.034"
+func parseUpstreamTime(value string) (float64, bool) {
+	if value == "" {
+		return 0, false
+	}
+	total := 0.0
+	for _, part := range strings.Split(value, ",") {
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return 0, false
+		}
+		total += seconds
+	}
+	return total, true
+}
+
+// informationalWriter wraps a gin.ResponseWriter and records the informational statuses, other
+// than 101, sent before the final one. gin only sends the status on WriteHeaderNow, Write,
+// WriteString or Flush, so one set by WriteHeader and replaced before isn't recorded
+type informationalWriter struct {
+	gin.ResponseWriter
+	codes []int
+}
+
+// sending records the status if it is informational and about to be sent
+func (w *informationalWriter) sending() {
+	if code := w.Status(); !w.Written() && code/100 == 1 && code != http.StatusSwitchingProtocols {
+		w.codes = append(w.codes, code)
+	}
+}
+
+func (w *informationalWriter) WriteHeaderNow() {
+	w.sending()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *informationalWriter) Write(b []byte) (int, error) {
+	w.sending()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *informationalWriter) WriteString(s string) (int, error) {
+	w.sending()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *informationalWriter) Flush() {
+	w.sending()
+	w.ResponseWriter.Flush()
+}
+
+// failingWriter wraps a gin.ResponseWriter and records whether writing the response failed. gin
+// records the render errors as private errors, indistinguishable from the others
+type failingWriter struct {
+	gin.ResponseWriter
+	failed bool
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+func (w *failingWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// hijackWriter wraps a gin.ResponseWriter and records whether its connection was hijacked
+type hijackWriter struct {
+	gin.ResponseWriter
+	hijacked bool
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// From https://github.com/DanielHeckrath/gin-prometheus/blob/master/gin_prometheus.go, also
+// returns the size of the largest header value
+func computeApproximateRequestSize(r *http.Request) (int, int) {
 	s := 0
 	if r.URL != nil {
 		s = len(r.URL.Path)
@@ -402,10 +4042,14 @@ func computeApproximateRequestSize(r *http.Request) int {
 
 	s += len(r.Method)
 	s += len(r.Proto)
+	max := 0
 	for name, values := range r.Header {
 		s += len(name)
 		for _, value := range values {
 			s += len(value)
+			if len(value) > max {
+				max = len(value)
+			}
 		}
 	}
 	s += len(r.Host)
@@ -415,5 +4059,5 @@ func computeApproximateRequestSize(r *http.Request) int {
 	if r.ContentLength != -1 {
 		s += int(r.ContentLength)
 	}
-	return s
+	return s, max
 }
@@ -0,0 +1,2607 @@
+package ginprometheus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// request serves a request without body to h and returns the response
+func request(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// findMetric returns the series of the metric family name gathered from g which has the labels,
+// or nil
+func findMetric(t *testing.T, g prometheus.Gatherer, name string, labels prometheus.Labels) *dto.Metric {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if hasLabels(m, labels) {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func hasLabels(m *dto.Metric, labels prometheus.Labels) bool {
+	for name, value := range labels {
+		found := false
+		for _, l := range m.GetLabel() {
+			if l.GetName() == name && l.GetValue() == value {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// metricValue returns the value of the series of the default registry with the labels: the
+// value of counters and gauges, or the sample count of histograms and summaries
+func metricValue(t *testing.T, name string, labels prometheus.Labels) float64 {
+	t.Helper()
+	m := findMetric(t, prometheus.DefaultGatherer, name, labels)
+	if m == nil {
+		t.Fatalf("no series of %s with labels %v", name, labels)
+	}
+	switch {
+	case m.Histogram != nil:
+		return float64(m.GetHistogram().GetSampleCount())
+	case m.Summary != nil:
+		return float64(m.GetSummary().GetSampleCount())
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestTrackRateLimited(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "ratelimited", TrackRateLimited: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/limited", func(c *gin.Context) {
+		p.MarkRateLimited(c)
+		c.AbortWithStatus(http.StatusTooManyRequests)
+	})
+	e.GET("/ok", func(c *gin.Context) {})
+
+	request(e, "GET", "/limited")
+	request(e, "GET", "/limited")
+	request(e, "GET", "/ok")
+
+	if v := metricValue(t, "ratelimited_requests_rate_limited_total", prometheus.Labels{"url": "/limited"}); v != 2 {
+		t.Errorf("rate limited count of /limited = %v, want 2", v)
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "ratelimited_requests_rate_limited_total", prometheus.Labels{"url": "/ok"}); m != nil {
+		t.Errorf("/ok counted as rate limited")
+	}
+	if v := metricValue(t, "ratelimited_requests_total", prometheus.Labels{"url": "/limited", "code": "429"}); v != 2 {
+		t.Errorf("request count of /limited = %v, want 2", v)
+	}
+}
+
+// slowReader delays every read by delay
+type slowReader struct {
+	io.Reader
+	delay time.Duration
+}
+
+func (r slowReader) Read(b []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.Reader.Read(b)
+}
+
+func TestExcludeBodyReadFromDuration(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "bodyread", ExcludeBodyReadFromDuration: true})
+	e := gin.New()
+	p.Use(e)
+	e.POST("/upload", func(c *gin.Context) {
+		ioutil.ReadAll(c.Request.Body)
+	})
+
+	body := slowReader{Reader: strings.NewReader("payload"), delay: 50 * time.Millisecond}
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", body))
+
+	m := findMetric(t, prometheus.DefaultGatherer, "bodyread_request_duration_seconds", prometheus.Labels{"url": "/upload"})
+	if m == nil {
+		t.Fatal("request duration not observed")
+	}
+	if sum := m.GetHistogram().GetSampleSum(); sum >= 0.05 {
+		t.Errorf("request duration = %vs, want the body read time excluded", sum)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	snapshots := make(chan []*dto.MetricFamily, 10)
+	p := NewWithConfig(Config{
+		Subsystem:        "snapshot",
+		SnapshotInterval: 10 * time.Millisecond,
+		OnSnapshot:       func(families []*dto.MetricFamily) { snapshots <- families },
+		SnapshotReset:    true,
+	})
+	defer p.StopSnapshots()
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+
+	counted := func(families []*dto.MetricFamily) bool {
+		for _, family := range families {
+			if family.GetName() == "snapshot_requests_total" && len(family.GetMetric()) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	select {
+	case families := <-snapshots:
+		if !counted(families) {
+			t.Fatal("snapshot without the request count")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no snapshot taken")
+	}
+	// the vectors are reset after the first snapshot
+	select {
+	case families := <-snapshots:
+		if counted(families) {
+			t.Error("request count not reset after the snapshot")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no second snapshot taken")
+	}
+}
+
+func TestDefaultSubsystem(t *testing.T) {
+	defer func(subsystem string) { DefaultSubsystem = subsystem }(DefaultSubsystem)
+	DefaultSubsystem = "defaultsubsystem"
+
+	p := NewWithConfig(Config{})
+	if got := p.Subsystem(); got != "defaultsubsystem" {
+		t.Errorf("Subsystem() = %q, want defaultsubsystem", got)
+	}
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+	if v := metricValue(t, "defaultsubsystem_requests_total", prometheus.Labels{"url": "/x"}); v != 1 {
+		t.Errorf("request count = %v, want 1", v)
+	}
+}
+
+func TestJSONMetricsPath(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "jsonmetrics", JSONMetricsPath: "/metrics.json"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	e.GET("/missing", func(c *gin.Context) { c.Status(http.StatusNotFound) })
+	request(e, "GET", "/x")
+	request(e, "GET", "/x")
+	request(e, "GET", "/missing")
+
+	w := request(e, "GET", "/metrics.json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	var summary jsonSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	// the JSON path itself isn't counted
+	if summary.RequestsTotal != 3 || summary.ByStatus["200"] != 2 || summary.ByStatus["404"] != 1 {
+		t.Errorf("summary = %+v, want 3 requests, 2 200s and 1 404", summary)
+	}
+}
+
+func TestLabelHook(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem: "labelhook",
+		LabelHook: func(c *gin.Context, labels prometheus.Labels) {
+			if strings.HasPrefix(labels["url"], "/users/") {
+				labels["url"] = "/users/redacted"
+			}
+			labels["unknown"] = "ignored"
+		},
+	})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/users/:name", func(c *gin.Context) {})
+	request(e, "GET", "/users/alice")
+
+	if v := metricValue(t, "labelhook_requests_total", prometheus.Labels{"url": "/users/redacted"}); v != 1 {
+		t.Errorf("request count = %v, want 1", v)
+	}
+	if v := metricValue(t, "labelhook_request_duration_seconds", prometheus.Labels{"url": "/users/redacted"}); v != 1 {
+		t.Errorf("request duration count = %v, want 1", v)
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "labelhook_requests_total", prometheus.Labels{"url": "/users/alice"}); m != nil {
+		t.Error("url recorded before the hook")
+	}
+}
+
+func TestPathSourceFullPath(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "pathsource", PathSource: FullPath})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/users/:id", func(c *gin.Context) {})
+
+	// an outer handler embedding the engine under a prefix, as with http.StripPrefix
+	outer := http.StripPrefix("/api", e)
+	request(outer, "GET", "/api/users/1")
+	request(outer, "GET", "/api/users/2")
+
+	if v := metricValue(t, "pathsource_requests_total", prometheus.Labels{"url": "/users/:id"}); v != 2 {
+		t.Errorf("request count of /users/:id = %v, want 2", v)
+	}
+}
+
+func TestEnableFrameworkInfo(t *testing.T) {
+	NewWithConfig(Config{Subsystem: "frameworkinfo", EnableFrameworkInfo: true})
+	// a second instance doesn't fail on the already registered gauge
+	NewWithConfig(Config{Subsystem: "frameworkinfo2", EnableFrameworkInfo: true})
+
+	if v := metricValue(t, "gin_framework_info", prometheus.Labels{"gin_version": gin.Version}); v != 1 {
+		t.Errorf("gin_framework_info = %v, want 1", v)
+	}
+}
+
+// zeroStatusWriter reports a 0 status, as some wrapping writers do before a status is written
+type zeroStatusWriter struct {
+	gin.ResponseWriter
+}
+
+func (w zeroStatusWriter) Status() int {
+	return 0
+}
+
+func TestDefaultStatusCode(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "defaultstatus", DefaultStatusCode: 499})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/zero", func(c *gin.Context) {
+		c.Writer = zeroStatusWriter{c.Writer}
+	})
+	e.GET("/ok", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	e.GET("/unwritten", func(c *gin.Context) {})
+	request(e, "GET", "/zero")
+	request(e, "GET", "/ok")
+	request(e, "GET", "/unwritten")
+
+	if v := metricValue(t, "defaultstatus_requests_total", prometheus.Labels{"url": "/zero", "code": "499"}); v != 1 {
+		t.Errorf("request count of /zero with code 499 = %v, want 1", v)
+	}
+	for _, url := range []string{"/ok", "/unwritten"} {
+		if v := metricValue(t, "defaultstatus_requests_total", prometheus.Labels{"url": url, "code": "200"}); v != 1 {
+			t.Errorf("request count of %s with code 200 = %v, want 1", url, v)
+		}
+	}
+}
+
+func TestSplitDurationHistograms(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "splitduration", SplitDurationHistograms: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/fast", func(c *gin.Context) {})
+	request(e, "GET", "/fast")
+
+	if v := metricValue(t, "splitduration_request_duration_fast_seconds", prometheus.Labels{"url": "/fast"}); v != 1 {
+		t.Errorf("fast duration count = %v, want 1", v)
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "splitduration_request_duration_slow_seconds", nil); m != nil {
+		t.Error("fast request observed as slow")
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "splitduration_request_duration_seconds", nil); m != nil {
+		t.Error("request_duration_seconds still observed")
+	}
+}
+
+func TestMinSizeToObserve(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "minsize", MinSizeToObserve: 1000})
+	e := gin.New()
+	p.Use(e)
+	e.POST("/x", func(c *gin.Context) { c.String(http.StatusOK, "small") })
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/x", strings.NewReader("small")))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/x", strings.NewReader(strings.Repeat("large", 300))))
+
+	if v := metricValue(t, "minsize_request_size_bytes", nil); v != 1 {
+		t.Errorf("request size count = %v, want only the large request", v)
+	}
+	if v := metricValue(t, "minsize_response_size_bytes", nil); v != 0 {
+		t.Errorf("response size count = %v, want no small response", v)
+	}
+}
+
+func TestEnableConfigInfo(t *testing.T) {
+	NewWithConfig(Config{Subsystem: "configinfo", EnableConfigInfo: true, SplitDurationHistograms: true})
+	// a second instance has its own series
+	NewWithConfig(Config{Subsystem: "configinfo2", EnableConfigInfo: true})
+
+	labels := prometheus.Labels{"split_duration_histograms": "true", "enable_config_info": "true", "track_1xx": "false"}
+	if v := metricValue(t, "configinfo_ginprometheus_config_info", labels); v != 1 {
+		t.Errorf("configinfo_ginprometheus_config_info = %v, want 1", v)
+	}
+	if v := metricValue(t, "configinfo2_ginprometheus_config_info", prometheus.Labels{"split_duration_histograms": "false"}); v != 1 {
+		t.Errorf("configinfo2_ginprometheus_config_info = %v, want 1", v)
+	}
+}
+
+func TestSetURLMapping(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "urlmapping"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/customers/:name", func(c *gin.Context) {})
+	e.GET("/orders/:id", func(c *gin.Context) {})
+	p.SetURLMapping("/customers/:name", func(c *gin.Context) string { return "/customers/:name" })
+	request(e, "GET", "/customers/alice")
+	request(e, "GET", "/customers/bob")
+	request(e, "GET", "/orders/1")
+
+	if v := metricValue(t, "urlmapping_requests_total", prometheus.Labels{"url": "/customers/:name"}); v != 2 {
+		t.Errorf("request count of /customers/:name = %v, want 2", v)
+	}
+	// routes without a mapping keep ReqCntURLLabelMappingFn
+	if v := metricValue(t, "urlmapping_requests_total", prometheus.Labels{"url": "/orders/1"}); v != 1 {
+		t.Errorf("request count of /orders/1 = %v, want 1", v)
+	}
+}
+
+// overlappingReads reads the request body from two goroutines at once, so that the summed read
+// time exceeds the request duration and the duration net of the body read is negative
+func overlappingReads(c *gin.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// staggered so that the reads don't record their time at once
+			time.Sleep(time.Duration(i) * 10 * time.Millisecond)
+			c.Request.Body.Read(make([]byte, 1))
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestNegativeDurationClamped(t *testing.T) {
+	for _, skipZero := range []bool{false, true} {
+		subsystem := fmt.Sprintf("clamped_%t", skipZero)
+		p := NewWithConfig(Config{Subsystem: subsystem, ExcludeBodyReadFromDuration: true, SkipZeroDuration: skipZero})
+		e := gin.New()
+		p.Use(e)
+		e.POST("/x", overlappingReads)
+		body := slowReader{Reader: strings.NewReader("payload"), delay: 50 * time.Millisecond}
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/x", body))
+
+		m := findMetric(t, prometheus.DefaultGatherer, subsystem+"_request_duration_seconds", nil)
+		switch {
+		case skipZero && m != nil:
+			t.Error("zero duration observed with SkipZeroDuration")
+		case !skipZero && m == nil:
+			t.Error("clamped duration not observed")
+		case !skipZero && m.GetHistogram().GetSampleSum() != 0:
+			t.Errorf("duration = %v, want negative durations clamped to 0", m.GetHistogram().GetSampleSum())
+		}
+		if v := metricValue(t, subsystem+"_requests_total", nil); v != 1 {
+			t.Errorf("request count = %v, want 1", v)
+		}
+	}
+}
+
+func TestDeleteFromPushGateway(t *testing.T) {
+	var method, path string
+	status := http.StatusAccepted
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		w.WriteHeader(status)
+	}))
+	defer gateway.Close()
+
+	p := NewWithConfig(Config{Subsystem: "pushdelete"})
+	p.Ppg.PushGatewayURL = gateway.URL
+	p.SetPushGatewayJob("batch")
+	if err := p.DeleteFromPushGateway(); err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodDelete || !strings.HasPrefix(path, "/metrics/job/batch/instance/") {
+		t.Errorf("request = %s %s, want DELETE /metrics/job/batch/instance/...", method, path)
+	}
+
+	status = http.StatusInternalServerError
+	if err := p.DeleteFromPushGateway(); err == nil {
+		t.Error("no error on a failed delete")
+	}
+}
+
+func TestRegisterMetricDedup(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "registermetric"})
+
+	var wg sync.WaitGroup
+	registered := make([]*Metric, 10)
+	for i := range registered {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m, err := p.RegisterMetric(&Metric{ID: "jobs", Name: "jobs_total", Description: "Jobs.", Type: "counter"})
+			if err != nil {
+				t.Error(err)
+			}
+			registered[i] = m
+		}(i)
+	}
+	wg.Wait()
+
+	for _, m := range registered[1:] {
+		if m != registered[0] {
+			t.Fatal("concurrent registrations of the same ID returned different metrics")
+		}
+	}
+	registered[0].MetricCollector.(prometheus.Counter).Inc()
+	if v := metricValue(t, "registermetric_jobs_total", nil); v != 1 {
+		t.Errorf("jobs_total = %v, want 1", v)
+	}
+}
+
+func TestUseWithRegistry(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "perengine"})
+	reg1, reg2 := prometheus.NewRegistry(), prometheus.NewRegistry()
+	e1, e2 := gin.New(), gin.New()
+	p.UseWithRegistry(e1, reg1)
+	p.UseWithRegistry(e2, reg2)
+	e1.GET("/x", func(c *gin.Context) {})
+	e2.GET("/x", func(c *gin.Context) {})
+	request(e1, "GET", "/x")
+	request(e1, "GET", "/x")
+	request(e2, "GET", "/x")
+
+	for reg, want := range map[*prometheus.Registry]float64{reg1: 2, reg2: 1} {
+		m := findMetric(t, reg, "perengine_requests_total", prometheus.Labels{"url": "/x"})
+		if m == nil || m.GetCounter().GetValue() != want {
+			t.Errorf("request count = %v, want %v", m.GetCounter().GetValue(), want)
+		}
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "perengine_requests_total", nil); m != nil {
+		t.Error("requests recorded in the default registry")
+	}
+	if body := request(e1, "GET", "/metrics").Body.String(); !strings.Contains(body, `perengine_requests_total{code="200"`) {
+		t.Errorf("metrics path of the engine doesn't serve its registry:\n%s", body)
+	}
+}
+
+func TestHandlerLabelFromRoute(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "handlerroute", HandlerLabelFromRoute: true})
+	e := gin.New()
+	p.Use(e)
+	shared := func(c *gin.Context) {}
+	g := e.Group("/v1")
+	g.GET("/a", shared)
+	g.GET("/b", shared)
+	request(e, "GET", "/v1/a")
+	request(e, "GET", "/v1/b")
+
+	for _, route := range []string{"/v1/a", "/v1/b"} {
+		if v := metricValue(t, "handlerroute_requests_total", prometheus.Labels{"handler": route}); v != 1 {
+			t.Errorf("request count of handler %s = %v, want 1", route, v)
+		}
+	}
+}
+
+func TestRoleFn(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem: "role",
+		RoleFn: func(c *gin.Context) string {
+			if role := c.GetString("role"); role != "" {
+				return role
+			}
+			return "anonymous"
+		},
+	})
+	e := gin.New()
+	e.Use(func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			c.Set("role", "admin")
+		}
+	})
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	request(e, "GET", "/x")
+
+	for _, role := range []string{"admin", "anonymous"} {
+		if v := metricValue(t, "role_requests_total", prometheus.Labels{"role": role}); v != 1 {
+			t.Errorf("request count of role %s = %v, want 1", role, v)
+		}
+	}
+}
+
+func TestMeasureSelfOverhead(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "overhead", MeasureSelfOverhead: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/slow", func(c *gin.Context) { time.Sleep(50 * time.Millisecond) })
+	request(e, "GET", "/slow")
+
+	m := findMetric(t, prometheus.DefaultGatherer, "overhead_instrumentation_overhead_seconds", nil)
+	if m == nil || m.GetSummary().GetSampleCount() != 1 {
+		t.Fatal("overhead not observed once")
+	}
+	// the handler time is excluded
+	if sum := m.GetSummary().GetSampleSum(); sum >= 0.05 {
+		t.Errorf("overhead = %vs, want the handler time excluded", sum)
+	}
+}
+
+func TestTrackScrapeDuration(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "scrapeduration", TrackScrapeDuration: true})
+	e := gin.New()
+	p.Use(e)
+	if w := request(e, "GET", "/metrics"); w.Code != http.StatusOK {
+		t.Fatalf("scrape status = %d, want 200", w.Code)
+	}
+
+	if v := metricValue(t, "scrapeduration_scrape_duration_seconds", nil); v != 1 {
+		t.Errorf("scrape duration count = %v, want 1", v)
+	}
+	// the scrape itself isn't counted as a request
+	if m := findMetric(t, prometheus.DefaultGatherer, "scrapeduration_requests_total", nil); m != nil {
+		t.Error("scrape counted as a request")
+	}
+}
+
+func TestEmitLowCardinalityMirror(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "lowcardinality", EmitLowCardinalityMirror: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/users/:id", func(c *gin.Context) {
+		if c.Param("id") == "0" {
+			c.Status(http.StatusNotFound)
+		}
+	})
+	request(e, "GET", "/users/1")
+	request(e, "GET", "/users/2")
+	request(e, "GET", "/users/0")
+
+	for class, want := range map[string]float64{"2xx": 2, "4xx": 1} {
+		if v := metricValue(t, "lowcardinality_requests_total_low_cardinality", prometheus.Labels{"code_class": class, "method": "GET"}); v != want {
+			t.Errorf("request count of %s = %v, want %v", class, v, want)
+		}
+	}
+}
+
+func TestExpositionFormatProtobuf(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "protobufonly", ExpositionFormat: ProtobufFormat})
+	e := gin.New()
+	p.Use(e)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "text/plain")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	if got := expfmt.ResponseFormat(w.Header()); got != expfmt.FmtProtoDelim {
+		t.Errorf("format = %s, want %s", got, expfmt.FmtProtoDelim)
+	}
+}
+
+func TestSplitReadWriteDuration(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "readwrite", SplitReadWriteDuration: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	e.POST("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+	request(e, "POST", "/x")
+	request(e, "POST", "/x")
+
+	if v := metricValue(t, "readwrite_request_read_duration_seconds", prometheus.Labels{"method": "GET"}); v != 1 {
+		t.Errorf("read duration count = %v, want 1", v)
+	}
+	if v := metricValue(t, "readwrite_request_write_duration_seconds", prometheus.Labels{"method": "POST"}); v != 2 {
+		t.Errorf("write duration count = %v, want 2", v)
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "readwrite_request_duration_seconds", nil); m != nil {
+		t.Error("request_duration_seconds still observed")
+	}
+}
+
+func TestCatchAllURLLabel(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "catchall"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/files/*filepath", func(c *gin.Context) {})
+	e.GET("/users/:id", func(c *gin.Context) {})
+	request(e, "GET", "/files/a.txt")
+	request(e, "GET", "/files/dir/b.txt")
+	request(e, "GET", "/users/1")
+
+	if v := metricValue(t, "catchall_requests_total", prometheus.Labels{"url": "/files/*filepath"}); v != 2 {
+		t.Errorf("request count of /files/*filepath = %v, want 2", v)
+	}
+	// routes with named parameters only keep their path
+	if v := metricValue(t, "catchall_requests_total", prometheus.Labels{"url": "/users/1"}); v != 1 {
+		t.Errorf("request count of /users/1 = %v, want 1", v)
+	}
+}
+
+func TestIgnorePathsAndMethods(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "ignored", IgnorePaths: []string{"/healthz"}, IgnoreMethods: []string{"OPTIONS"}})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/healthz", func(c *gin.Context) {})
+	e.GET("/x", func(c *gin.Context) {})
+	e.OPTIONS("/x", func(c *gin.Context) {})
+	request(e, "GET", "/healthz")
+	request(e, "OPTIONS", "/x")
+	request(e, "GET", "/x")
+
+	if v := metricValue(t, "ignored_requests_total", nil); v != 1 {
+		t.Errorf("request count = %v, want only GET /x", v)
+	}
+	if v := metricValue(t, "ignored_request_size_bytes", nil); v != 1 {
+		t.Errorf("request size count = %v, want only GET /x", v)
+	}
+}
+
+func TestRequestIDExemplar(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "requestid", RequestIDHeader: "X-Request-Id"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	for _, id := range []string{"req-1", "\xff invalid", strings.Repeat("long", 40)} {
+		req := httptest.NewRequest("GET", "/x", nil)
+		req.Header.Set("X-Request-Id", id)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	m := findMetric(t, prometheus.DefaultGatherer, "requestid_request_duration_seconds", nil)
+	if m == nil || m.GetHistogram().GetSampleCount() != 3 {
+		t.Fatal("requests not observed")
+	}
+	var ids []string
+	for _, bucket := range m.GetHistogram().GetBucket() {
+		for _, l := range bucket.GetExemplar().GetLabel() {
+			ids = append(ids, l.GetName()+"="+l.GetValue())
+		}
+	}
+	if len(ids) != 1 || ids[0] != "request_id=req-1" {
+		t.Errorf("exemplars = %v, want only the valid request id", ids)
+	}
+
+	// exemplars are only exposed in the OpenMetrics format
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `# {request_id="req-1"}`) {
+		t.Errorf("request id exemplar not exposed:\n%s", w.Body.String())
+	}
+}
+
+func TestMetricsRouterUseDefault(t *testing.T) {
+	for useDefault, handlers := range map[bool]int{false: 0, true: 2} {
+		p := NewWithConfig(Config{Subsystem: fmt.Sprintf("metricsrouter_%t", useDefault), MetricsRouterUseDefault: useDefault})
+		p.SetListenAddress("127.0.0.1:0")
+		// gin.Default() adds the Logger and Recovery middleware
+		if got := len(p.router.Handlers); got != handlers {
+			t.Errorf("metrics router with MetricsRouterUseDefault %t has %d handlers, want %d", useDefault, got, handlers)
+		}
+	}
+}
+
+func TestTrackSimpleCounter(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "simplecounter", TrackSimpleCounter: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/a", func(c *gin.Context) {})
+	e.GET("/b", func(c *gin.Context) {})
+	request(e, "GET", "/a")
+	request(e, "GET", "/b")
+	request(e, "GET", "/missing")
+
+	if v := metricValue(t, "simplecounter_requests_served_total", nil); v != 3 {
+		t.Errorf("requests_served_total = %v, want 3", v)
+	}
+}
+
+func TestUseOnGroupWithLabel(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "mount", MountLabel: true})
+	e := gin.New()
+	admin, shop := e.Group("/admin"), e.Group("/shop")
+	p.UseOnGroupWithLabel(admin, "admin")
+	p.UseOnGroupWithLabel(shop, "shop")
+	admin.GET("/users", func(c *gin.Context) {})
+	shop.GET("/cart", func(c *gin.Context) {})
+	request(e, "GET", "/admin/users")
+	request(e, "GET", "/shop/cart")
+	request(e, "GET", "/shop/cart")
+
+	for mount, want := range map[string]float64{"admin": 1, "shop": 2} {
+		if v := metricValue(t, "mount_requests_total", prometheus.Labels{"mount": mount}); v != want {
+			t.Errorf("request count of mount %s = %v, want %v", mount, v, want)
+		}
+	}
+}
+
+func TestRouteLabels(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem: "routelabels",
+		RouteLabels: map[string]map[string]string{
+			"/billing/*":            {"team": "payments"},
+			"/billing/invoices/:id": {"team": "invoicing"},
+		},
+	})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/billing/cards", func(c *gin.Context) {})
+	e.GET("/billing/invoices/:id", func(c *gin.Context) {})
+	e.GET("/other", func(c *gin.Context) {})
+	request(e, "GET", "/billing/cards")
+	request(e, "GET", "/billing/invoices/1")
+	request(e, "GET", "/other")
+
+	for url, team := range map[string]string{"/billing/cards": "payments", "/billing/invoices/1": "invoicing", "/other": ""} {
+		if v := metricValue(t, "routelabels_requests_total", prometheus.Labels{"url": url, "team": team}); v != 1 {
+			t.Errorf("request count of %s with team %q = %v, want 1", url, team, v)
+		}
+	}
+}
+
+func TestRouteLabelsKeysMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic on route labels with different keys")
+		}
+	}()
+	NewWithConfig(Config{
+		Subsystem: "routelabelsmismatch",
+		RouteLabels: map[string]map[string]string{
+			"/a": {"team": "a"},
+			"/b": {"owner": "b"},
+		},
+	})
+}
+
+func TestTrackColdStart(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "coldstart", TrackColdStart: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/cold", func(c *gin.Context) { time.Sleep(30 * time.Millisecond) })
+	e.GET("/warm", func(c *gin.Context) {})
+	request(e, "GET", "/cold")
+	request(e, "GET", "/warm")
+
+	// only the first request sets the gauge
+	if v := metricValue(t, "coldstart_cold_start_duration_seconds", nil); v < 0.03 {
+		t.Errorf("cold start duration = %vs, want the duration of the first request", v)
+	}
+}
+
+func TestPushFormatProtobuf(t *testing.T) {
+	var contentType string
+	var families int
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		dec := expfmt.NewDecoder(r.Body, expfmt.FmtProtoDelim)
+		for {
+			var family dto.MetricFamily
+			if dec.Decode(&family) != nil {
+				break
+			}
+			families++
+		}
+	}))
+	defer gateway.Close()
+
+	p := NewWithConfig(Config{Subsystem: "pushprotobuf"})
+	p.Ppg.PushGatewayURL = gateway.URL
+	p.Ppg.Format = expfmt.FmtProtoDelim
+	p.sendMetricsToPushGateway(p.getMetrics())
+
+	if contentType != string(expfmt.FmtProtoDelim) {
+		t.Errorf("Content-Type = %q, want %q", contentType, expfmt.FmtProtoDelim)
+	}
+	if families == 0 {
+		t.Error("no metric family decoded from the push")
+	}
+}
+
+func TestDiagnosticHeaders(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "diagheaders", DiagnosticHeaders: []string{"User-Agent", "X-Client"}})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	for _, agent := range []string{"curl", "firefox", "curl"} {
+		req := httptest.NewRequest("GET", "/x", nil)
+		req.Header.Set("User-Agent", agent)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if v := metricValue(t, "diagheaders_header_cardinality", prometheus.Labels{"header": "User-Agent"}); v != 2 {
+		t.Errorf("User-Agent cardinality = %v, want 2", v)
+	}
+	// headers never seen have no series
+	if m := findMetric(t, prometheus.DefaultGatherer, "diagheaders_header_cardinality", prometheus.Labels{"header": "X-Client"}); m != nil {
+		t.Error("X-Client cardinality recorded")
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	// a gauge of the application taking the name of the request size summary, registered after
+	// the request count and duration
+	conflicting := prometheus.NewGauge(prometheus.GaugeOpts{Name: "failfast_request_size_bytes", Help: "Conflicting."})
+	prometheus.MustRegister(conflicting)
+	defer prometheus.Unregister(conflicting)
+
+	if _, err := NewWithConfigE(Config{Subsystem: "failfast", FailFast: true}); err == nil {
+		t.Fatal("no error registering a conflicting metric with FailFast")
+	}
+	// without FailFast the error is logged and the other metrics are registered, which requires
+	// those of the first attempt to have been unregistered
+	p, err := NewWithConfigE(Config{Subsystem: "failfast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+	if v := metricValue(t, "failfast_requests_total", nil); v != 1 {
+		t.Errorf("request count = %v, want 1", v)
+	}
+}
+
+func TestTrackRenderTime(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "rendertime", TrackRenderTime: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {
+		time.Sleep(50 * time.Millisecond)
+		c.Writer.WriteString("first")
+		time.Sleep(30 * time.Millisecond)
+		c.Writer.WriteString("second")
+	})
+	e.GET("/empty", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+	request(e, "GET", "/empty")
+
+	m := findMetric(t, prometheus.DefaultGatherer, "rendertime_render_duration_seconds", prometheus.Labels{"url": "/x"})
+	if m == nil {
+		t.Fatal("render duration not observed")
+	}
+	if sum := m.GetHistogram().GetSampleSum(); sum < 0.03 || sum >= 0.08 {
+		t.Errorf("render duration = %vs, want from the first write to the end", sum)
+	}
+	// responses without body have no render duration
+	if m := findMetric(t, prometheus.DefaultGatherer, "rendertime_render_duration_seconds", prometheus.Labels{"url": "/empty"}); m != nil {
+		t.Error("render duration observed without body")
+	}
+}
+
+// exemplarLabels returns the labels of the exemplars of the histogram series m, as name=value
+func exemplarLabels(m *dto.Metric) []string {
+	var labels []string
+	for _, bucket := range m.GetHistogram().GetBucket() {
+		for _, l := range bucket.GetExemplar().GetLabel() {
+			labels = append(labels, l.GetName()+"="+l.GetValue())
+		}
+	}
+	return labels
+}
+
+func TestTraceparentExemplar(t *testing.T) {
+	for header, want := range map[string]string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       "4bf92f3577b34da6a3ce929d0e0e4736",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"": "",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": "",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       "",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":       "",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":       "",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":       "",
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/", nil)
+		c.Request.Header.Set("traceparent", header)
+		if got := TraceparentExemplar(c)["trace_id"]; got != want {
+			t.Errorf("trace id of %q = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestExemplarFromContext(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "traceparent", ExemplarFromContext: TraceparentExemplar})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	m := findMetric(t, prometheus.DefaultGatherer, "traceparent_request_duration_seconds", nil)
+	if got := exemplarLabels(m); len(got) != 1 || got[0] != "trace_id=4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("exemplars = %v, want the trace id", got)
+	}
+}
+
+func TestMaxLabelValueLength(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "maxlabellength", MaxLabelValueLength: 10})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/short", func(c *gin.Context) {})
+	e.GET("/a/very/long/path", func(c *gin.Context) {})
+	request(e, "GET", "/short")
+	request(e, "GET", "/a/very/long/path")
+
+	for _, url := range []string{"/short", "/a/very..."} {
+		if v := metricValue(t, "maxlabellength_requests_total", prometheus.Labels{"url": url}); v != 1 {
+			t.Errorf("request count of %s = %v, want 1", url, v)
+		}
+		if v := metricValue(t, "maxlabellength_request_duration_seconds", prometheus.Labels{"url": url}); v != 1 {
+			t.Errorf("request duration count of %s = %v, want 1", url, v)
+		}
+	}
+}
+
+func TestURLLabelMethods(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "urlmethods", URLLabelMethods: []string{"get"}})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/items/:id", func(c *gin.Context) {})
+	e.POST("/items/:id", func(c *gin.Context) {})
+	request(e, "GET", "/items/1")
+	request(e, "POST", "/items/1")
+	request(e, "POST", "/items/2")
+
+	if v := metricValue(t, "urlmethods_requests_total", prometheus.Labels{"method": "GET", "url": "/items/1"}); v != 1 {
+		t.Errorf("request count of GET /items/1 = %v, want 1", v)
+	}
+	if v := metricValue(t, "urlmethods_requests_total", prometheus.Labels{"method": "POST", "url": AggregatedURLLabel}); v != 2 {
+		t.Errorf("aggregated request count of POST = %v, want 2", v)
+	}
+}
+
+func TestOperationNameContextKey(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "operationname", OperationNameContextKey: "operation"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/users/:id", func(c *gin.Context) { c.Set("operation", "getUser") })
+	e.GET("/other", func(c *gin.Context) { c.Set("operation", 42) })
+	request(e, "GET", "/users/1")
+	request(e, "GET", "/users/2")
+	request(e, "GET", "/other")
+
+	if v := metricValue(t, "operationname_requests_total", prometheus.Labels{"url": "getUser"}); v != 2 {
+		t.Errorf("request count of getUser = %v, want 2", v)
+	}
+	if v := metricValue(t, "operationname_request_duration_seconds", prometheus.Labels{"url": "getUser"}); v != 2 {
+		t.Errorf("request duration count of getUser = %v, want 2", v)
+	}
+	// non-string operation names are ignored
+	if v := metricValue(t, "operationname_requests_total", prometheus.Labels{"url": "/other"}); v != 1 {
+		t.Errorf("request count of /other = %v, want 1", v)
+	}
+}
+
+func TestURLLabelFromContextNotString(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "urlfromcontext"})
+	p.URLLabelFromContext = "url"
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) { c.Set("url", 42) })
+	request(e, "GET", "/x")
+
+	if v := metricValue(t, "urlfromcontext_requests_total", prometheus.Labels{"url": "unknown"}); v != 1 {
+		t.Errorf("request count of unknown = %v, want 1", v)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	var pushes int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pushes, 1)
+	}))
+	defer gateway.Close()
+
+	p := NewWithConfig(Config{
+		Subsystem:        "shutdown",
+		SnapshotInterval: time.Hour,
+		OnSnapshot:       func([]*dto.MetricFamily) {},
+	})
+	p.SetPushGateway(gateway.URL, "", time.Hour)
+	p.SetListenAddress("127.0.0.1:0")
+	p.Use(gin.New())
+
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if p.pushStop != nil {
+		t.Error("periodic pushes not stopped")
+	}
+	if p.snapshotStop != nil {
+		t.Error("periodic snapshots not stopped")
+	}
+	if n := atomic.LoadInt32(&pushes); n != 1 {
+		t.Errorf("%d pushes, want a final one", n)
+	}
+	if err := p.server.ListenAndServe(); err != http.ErrServerClosed {
+		t.Errorf("metrics server not shut down: %v", err)
+	}
+}
+
+func TestLabelValuesOrder(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem:   "labelorder",
+		RoleFn:      func(c *gin.Context) string { return "admin" },
+		RouteLabels: map[string]map[string]string{"/users/:id": {"team": "accounts"}},
+	})
+	e := gin.New()
+	p.Use(e)
+	e.POST("/users/:id", func(c *gin.Context) { c.Status(http.StatusCreated) })
+	request(e, "POST", "http://example.com/users/1")
+
+	m := findMetric(t, prometheus.DefaultGatherer, "labelorder_requests_total", nil)
+	if m == nil {
+		t.Fatal("no request counted")
+	}
+	want := map[string]string{
+		"code": "201", "method": "POST", "host": "example.com", "url": "/users/1", "role": "admin", "team": "accounts",
+	}
+	for _, l := range m.GetLabel() {
+		if value, ok := want[l.GetName()]; ok && l.GetValue() != value {
+			t.Errorf("label %s = %q, want %q", l.GetName(), l.GetValue(), value)
+		}
+	}
+	if v := metricValue(t, "labelorder_request_duration_seconds", prometheus.Labels{"code": "201", "method": "POST", "url": "/users/1"}); v != 1 {
+		t.Errorf("duration observations = %v, want 1", v)
+	}
+}
+
+var benchmarkPrometheus = NewWithConfig(Config{Subsystem: "benchmark", RoleFn: func(c *gin.Context) string { return "user" }})
+
+func BenchmarkHandlerFunc(b *testing.B) {
+	e := gin.New()
+	e.Use(benchmarkPrometheus.HandlerFunc())
+	e.GET("/users/:id", func(c *gin.Context) {})
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/users/1", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.ServeHTTP(w, req)
+	}
+}
+
+func TestRequestExemplarWithoutLabels(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/x", nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		if labels := requestExemplar(c, nil, "X-Request-Id", []string{"X-Trace-Id"}); labels != nil {
+			t.Fatalf("exemplar = %v, want none", labels)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations without exemplar labels, want 0", allocs)
+	}
+
+	c.Request.Header.Set("X-Request-Id", "42")
+	if labels := requestExemplar(c, nil, "X-Request-Id", nil); labels["request_id"] != "42" {
+		t.Errorf("exemplar = %v, want the request id", labels)
+	}
+}
+
+func TestDurationAlsoSummary(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "alsosummary", DurationAlsoSummary: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+	request(e, "GET", "/x")
+
+	labels := prometheus.Labels{"code": "200", "method": "GET", "url": "/x"}
+	histogram := findMetric(t, prometheus.DefaultGatherer, "alsosummary_request_duration_seconds", labels)
+	if histogram == nil || histogram.GetHistogram().GetSampleCount() != 2 || len(histogram.GetHistogram().GetBucket()) == 0 {
+		t.Errorf("histogram = %v, want 2 observations in buckets", histogram)
+	}
+	summary := findMetric(t, prometheus.DefaultGatherer, "alsosummary_request_duration_summary_seconds", labels)
+	if summary == nil || summary.GetSummary().GetSampleCount() != 2 || len(summary.GetSummary().GetQuantile()) != 3 {
+		t.Errorf("summary = %v, want 2 observations with 3 quantiles", summary)
+	}
+}
+
+func TestTrackConcurrencyHistogram(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "concurrency", TrackConcurrencyHistogram: true})
+	e := gin.New()
+	p.Use(e)
+	var entered sync.WaitGroup
+	release := make(chan struct{})
+	e.GET("/x", func(c *gin.Context) {
+		entered.Done()
+		<-release
+	})
+
+	var done sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		entered.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			request(e, "GET", "/x")
+		}()
+	}
+	entered.Wait()
+	close(release)
+	done.Wait()
+
+	m := findMetric(t, prometheus.DefaultGatherer, "concurrency_requests_concurrency", nil)
+	if m == nil || m.GetHistogram().GetSampleCount() != 3 {
+		t.Fatalf("concurrency histogram = %v, want 3 observations", m)
+	}
+	if sum := m.GetHistogram().GetSampleSum(); sum != 1+2+3 {
+		t.Errorf("sum of the sampled concurrency = %v, want 6", sum)
+	}
+}
+
+func TestSizeHistograms(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "sizehistograms", SizeHistograms: true, SizeBuckets: []float64{10, 100}})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) { c.String(http.StatusOK, strings.Repeat("a", 50)) })
+	request(e, "GET", "/x")
+
+	body := request(e, "GET", "/metrics").Body.String()
+	if !strings.Contains(body, `sizehistograms_response_size_bytes_bucket{le="100"} 1`) {
+		t.Errorf("no le=\"100\" bucket with the response:\n%s", body)
+	}
+	if !strings.Contains(body, `sizehistograms_response_size_bytes_bucket{le="10"} 0`) {
+		t.Errorf("no empty le=\"10\" bucket:\n%s", body)
+	}
+
+	if _, err := NewWithConfigE(Config{Subsystem: "sizehistogramsunsorted", SizeBuckets: []float64{100, 10}}); err == nil {
+		t.Error("unsorted size buckets accepted")
+	}
+}
+
+func TestTrackWebSocketUpgrades(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "upgrades", TrackWebSocketUpgrades: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/ws", func(c *gin.Context) {
+		c.Header("Upgrade", "websocket")
+		c.Status(http.StatusSwitchingProtocols)
+		c.Writer.WriteHeaderNow()
+	})
+	request(e, "GET", "/ws")
+
+	if v := metricValue(t, "upgrades_websocket_upgrades_total", prometheus.Labels{"url": "/ws"}); v != 1 {
+		t.Errorf("upgrade count = %v, want 1", v)
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "upgrades_request_duration_seconds", prometheus.Labels{"url": "/ws"}); m != nil {
+		t.Error("duration of the upgraded request observed")
+	}
+}
+
+func TestInstrumented(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "instrumented"})
+	e := gin.New()
+	e.GET("/wrapped", p.Instrumented(func(c *gin.Context) {}))
+	e.GET("/plain", func(c *gin.Context) {})
+	request(e, "GET", "/wrapped")
+	request(e, "GET", "/plain")
+
+	if v := metricValue(t, "instrumented_requests_total", prometheus.Labels{"url": "/wrapped"}); v != 1 {
+		t.Errorf("request count of /wrapped = %v, want 1", v)
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "instrumented_requests_total", prometheus.Labels{"url": "/plain"}); m != nil {
+		t.Error("uninstrumented route counted")
+	}
+}
+
+// brokenPipeWriter is a http.ResponseWriter whose client went away
+type brokenPipeWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w brokenPipeWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func (w brokenPipeWriter) WriteString(s string) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestTrackRenderErrors(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "rendererrors", TrackRenderErrors: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"a": 1}) })
+	e.ServeHTTP(brokenPipeWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/x", nil))
+	request(e, "GET", "/x")
+
+	if v := metricValue(t, "rendererrors_render_errors_total", prometheus.Labels{"url": "/x"}); v != 1 {
+		t.Errorf("render error count = %v, want 1", v)
+	}
+}
+
+func TestUseWithRegistryShared(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p1 := NewWithConfig(Config{Subsystem: "shared"})
+	p2 := NewWithConfig(Config{Subsystem: "shared"})
+	e1, e2 := gin.New(), gin.New()
+	p1.UseWithRegistry(e1, reg)
+	p2.UseWithRegistry(e2, reg)
+	handler := func(c *gin.Context) {}
+	e1.GET("/x", handler)
+	e2.GET("/x", handler)
+	request(e1, "GET", "/x")
+	request(e2, "GET", "/x")
+
+	m := findMetric(t, reg, "shared_requests_total", prometheus.Labels{"url": "/x"})
+	if m == nil || m.GetCounter().GetValue() != 2 {
+		t.Errorf("shared request count = %v, want 2", m.GetCounter().GetValue())
+	}
+
+	p3 := NewWithConfig(Config{Subsystem: "shared", TrackRateLimited: true})
+	e3 := gin.New()
+	p3.UseWithRegistry(e3, reg)
+	e3.GET("/x", handler)
+	request(e3, "GET", "/x")
+	if m := findMetric(t, reg, "shared_requests_total", prometheus.Labels{"url": "/x"}); m.GetCounter().GetValue() != 2 {
+		t.Error("instance with other standard metrics recorded into the shared ones")
+	}
+
+	p1.ReleaseRegistry(reg)
+	if m := findMetric(t, reg, "shared_requests_total", nil); m == nil {
+		t.Error("shared metrics unregistered while still used")
+	}
+	p2.ReleaseRegistry(reg)
+	if m := findMetric(t, reg, "shared_requests_total", nil); m != nil {
+		t.Error("shared metrics still registered once released")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"30":                            30 * time.Second,
+		"0":                             0,
+		"Mon, 01 Jan 2024 00:02:00 GMT": 2 * time.Minute,
+		"Sun, 31 Dec 2023 23:00:00 GMT": 0,
+	} {
+		if got, ok := parseRetryAfter(value, now); !ok || got != want {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v", value, got, ok, want)
+		}
+	}
+	for _, value := range []string{"", "-1", "soon", "1.5"} {
+		if _, ok := parseRetryAfter(value, now); ok {
+			t.Errorf("malformed %q parsed", value)
+		}
+	}
+}
+
+func TestTrackRetryAfter(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "retryafter", TrackRetryAfter: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/limited", func(c *gin.Context) {
+		c.Header("Retry-After", "30")
+		c.Status(http.StatusTooManyRequests)
+	})
+	e.GET("/malformed", func(c *gin.Context) {
+		c.Header("Retry-After", "soon")
+		c.Status(http.StatusTooManyRequests)
+	})
+	request(e, "GET", "/limited")
+	request(e, "GET", "/malformed")
+
+	m := findMetric(t, prometheus.DefaultGatherer, "retryafter_retry_after_seconds", nil)
+	if m == nil || m.GetHistogram().GetSampleCount() != 1 || m.GetHistogram().GetSampleSum() != 30 {
+		t.Errorf("retry after histogram = %v, want a single 30s observation", m)
+	}
+}
+
+func TestCheckMetricsPath(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "pathconflict"})
+	e := gin.New()
+	e.GET("/*any", func(c *gin.Context) { c.String(http.StatusOK, "app") })
+	if err := p.CheckMetricsPath(e); err == nil {
+		t.Error("catch-all route conflicting with the metrics path not reported")
+	}
+	p.Use(e)
+	if body := request(e, "GET", "/metrics").Body.String(); body != "app" {
+		t.Errorf("conflicting route replaced: %q", body)
+	}
+
+	p = NewWithConfig(Config{Subsystem: "pathalternate", AlternateMetricsPath: true})
+	e = gin.New()
+	e.GET("/metrics", func(c *gin.Context) {})
+	p.Use(e)
+	if p.MetricsPath != "/metrics-2" {
+		t.Fatalf("metrics path = %s, want /metrics-2", p.MetricsPath)
+	}
+	if body := request(e, "GET", "/metrics-2").Body.String(); !strings.Contains(body, "pathalternate_request_size_bytes") {
+		t.Errorf("metrics not served on the alternate path:\n%s", body)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "reconfig_a"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+
+	if err := p.Reconfigure(Config{Subsystem: "reconfig_b"}); err != nil {
+		t.Fatal(err)
+	}
+	request(e, "GET", "/x")
+
+	if m := findMetric(t, prometheus.DefaultGatherer, "reconfig_a_requests_total", nil); m != nil {
+		t.Error("series of the previous subsystem still registered")
+	}
+	if v := metricValue(t, "reconfig_b_requests_total", prometheus.Labels{"url": "/x"}); v != 1 {
+		t.Errorf("request count after reconfiguring = %v, want 1", v)
+	}
+	if p.Subsystem() != "reconfig_b" {
+		t.Errorf("subsystem = %s, want reconfig_b", p.Subsystem())
+	}
+
+	if err := p.Reconfigure(Config{Subsystem: "reconfig_c", SizeBuckets: []float64{2, 1}}); err == nil {
+		t.Error("invalid configuration accepted")
+	}
+	request(e, "GET", "/x")
+	if v := metricValue(t, "reconfig_b_requests_total", prometheus.Labels{"url": "/x"}); v != 2 {
+		t.Errorf("request count after a failed reconfiguration = %v, want 2", v)
+	}
+}
+
+func TestReconfigureDrainsRecorder(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "reconfigdrain_a", AsyncBufferSize: 4})
+	release := make(chan struct{})
+	var recorded int32
+	p.recordings <- func() {
+		<-release
+		atomic.AddInt32(&recorded, 1)
+	}
+	p.recordings <- func() { atomic.AddInt32(&recorded, 1) }
+
+	reconfigured := make(chan error)
+	go func() {
+		reconfigured <- p.Reconfigure(Config{Subsystem: "reconfigdrain_b", AsyncBufferSize: 8})
+	}()
+	select {
+	case <-reconfigured:
+		t.Fatal("reconfigured before the queued recordings")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-reconfigured; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&recorded); n != 2 {
+		t.Errorf("%d queued recordings run, want 2", n)
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCanonicalEndpoint(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "canonical", CanonicalEndpoint: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/users/:id", func(c *gin.Context) {})
+	for i := 0; i < 5; i++ {
+		request(e, "GET", "/users/"+strconv.Itoa(i))
+	}
+
+	if v := metricValue(t, "canonical_requests_total", prometheus.Labels{"route": "/users/:id", "method": "GET"}); v != 5 {
+		t.Errorf("request count of /users/:id = %v, want 5", v)
+	}
+	if v := metricValue(t, "canonical_request_duration_seconds", prometheus.Labels{"route": "/users/:id", "method": "GET"}); v != 5 {
+		t.Errorf("duration observations of /users/:id = %v, want 5", v)
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "canonical_requests_total", prometheus.Labels{"url": "/users/1"}); m != nil {
+		t.Error("url label still recorded")
+	}
+}
+
+func TestSetMetricsPathE(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	p := NewWithConfig(Config{Subsystem: "addressinuse"})
+	p.SetListenAddress(busy.Addr().String())
+	if err := p.SetMetricsPathE(gin.New()); err == nil {
+		t.Error("no error listening on an address in use")
+	}
+}
+
+func TestRouteMethods(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "routemethods"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	e.POST("/x", func(c *gin.Context) {})
+	e.DELETE("/users/:id", func(c *gin.Context) {})
+
+	if got := p.RouteMethods("/x"); strings.Join(got, ",") != "GET,POST" {
+		t.Errorf("methods of /x = %v, want GET and POST", got)
+	}
+	if got := p.RouteMethods("/users/1"); strings.Join(got, ",") != "DELETE" {
+		t.Errorf("methods of /users/1 = %v, want DELETE", got)
+	}
+	if got := p.RouteMethods("/missing"); len(got) != 0 {
+		t.Errorf("methods of /missing = %v, want none", got)
+	}
+}
+
+func TestAsyncRecording(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "async", AsyncBufferSize: 8, DropPolicy: Block})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	for i := 0; i < 5; i++ {
+		request(e, "GET", "/x")
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v := metricValue(t, "async_requests_total", prometheus.Labels{"url": "/x"}); v != 5 {
+		t.Errorf("request count = %v, want 5", v)
+	}
+}
+
+func TestDropPolicy(t *testing.T) {
+	for policy, want := range map[DropPolicy]string{DropNewest: "first", DropOldest: "second", Block: "first second"} {
+		p := NewWithConfig(Config{Subsystem: "async_" + policy.String(), AsyncBufferSize: 1, DropPolicy: policy})
+		// replace the recorder with a buffer drained below, as slowly as needed
+		p.stopRecorder(context.Background())
+		recordings := make(chan func(), 1)
+		p.recordings = recordings
+
+		var recorded []string
+		p.enqueue(p.metrics, func() { recorded = append(recorded, "first") })
+		enqueued := make(chan struct{})
+		go func() {
+			p.enqueue(p.metrics, func() { recorded = append(recorded, "second") })
+			close(enqueued)
+		}()
+		if policy == Block {
+			select {
+			case <-enqueued:
+				t.Errorf("%s: enqueued into a full buffer", policy)
+			case <-time.After(20 * time.Millisecond):
+			}
+			(<-recordings)()
+		}
+		<-enqueued
+		close(recordings)
+		for record := range recordings {
+			record()
+		}
+
+		if got := strings.Join(recorded, " "); got != want {
+			t.Errorf("%s: recorded %q, want %q", policy, got, want)
+		}
+		dropped := 1.0
+		if policy == Block {
+			dropped = 0
+		}
+		if v := metricValue(t, "async_"+policy.String()+"_metrics_dropped_total", nil); v != dropped {
+			t.Errorf("%s: dropped count = %v, want %v", policy, v, dropped)
+		}
+	}
+}
+
+func TestUpstreamTimeHeader(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "upstream", UpstreamTimeHeader: "X-Upstream-Response-Time"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {
+		c.Header("X-Upstream-Response-Time", c.Query("t"))
+	})
+	request(e, "GET", "/x?t=0.25")
+	request(e, "GET", "/x?t=0.5,%200.25")
+	request(e, "GET", "/x?t=slow")
+	request(e, "GET", "/x")
+
+	m := findMetric(t, prometheus.DefaultGatherer, "upstream_upstream_response_seconds", nil)
+	if m == nil || m.GetHistogram().GetSampleCount() != 2 || m.GetHistogram().GetSampleSum() != 1 {
+		t.Errorf("upstream histogram = %v, want 0.25s and 0.75s", m)
+	}
+}
+
+func TestMetricValidation(t *testing.T) {
+	for want, m := range map[error]*Metric{
+		ErrEmptyMetricName:   {ID: "empty", Type: "counter"},
+		ErrInvalidMetricName: {ID: "invalid", Name: "jobs-total", Type: "counter"},
+		ErrUnknownMetricType: {ID: "unknown", Name: "jobs_total", Type: "meter"},
+	} {
+		_, err := NewWithConfigE(Config{Subsystem: "validation", MetricsList: []*Metric{m}})
+		if !errors.Is(err, want) {
+			t.Errorf("error of metric %s = %v, want %v", m.ID, err, want)
+		}
+	}
+}
+
+func TestLogInterval(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	p := NewWithConfig(Config{Subsystem: "loginterval", LogInterval: 10 * time.Millisecond})
+	defer p.StopLogging()
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	e.GET("/y", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+	request(e, "GET", "/x")
+	request(e, "GET", "/y")
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Request counts: /x=2 /y=1" {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("request counts not logged")
+}
+
+func TestObserveJob(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "jobs"})
+	if err := p.ObserveJob("import", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("queue unavailable")
+	if err := p.ObserveJob("import", func() error { return failure }); err != failure {
+		t.Errorf("error = %v, want that of the job", err)
+	}
+
+	for _, result := range []string{"success", "failure"} {
+		if v := metricValue(t, "jobs_job_runs_total", prometheus.Labels{"name": "import", "result": result}); v != 1 {
+			t.Errorf("%s runs = %v, want 1", result, v)
+		}
+	}
+	if v := metricValue(t, "jobs_job_duration_seconds", prometheus.Labels{"name": "import"}); v != 2 {
+		t.Errorf("job duration observations = %v, want 2", v)
+	}
+}
+
+func TestTrackRequestContentType(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "contenttype", TrackRequestContentType: true})
+	e := gin.New()
+	p.Use(e)
+	e.POST("/x", func(c *gin.Context) {})
+	req := httptest.NewRequest("POST", "/x", strings.NewReader("<a/>"))
+	req.Header.Set("Content-Type", "Application/XML; charset=utf-8")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	request(e, "POST", "/x")
+
+	for contentType, want := range map[string]float64{"application/xml": 1, "none": 1} {
+		if v := metricValue(t, "contenttype_requests_total", prometheus.Labels{"request_content_type": contentType}); v != want {
+			t.Errorf("request count of %s = %v, want %v", contentType, v, want)
+		}
+	}
+}
+
+func TestSummaryMaxAge(t *testing.T) {
+	defaults := metricDefaults{summaryMaxAge: time.Minute}
+	if m := defaults.apply(&Metric{Type: "summary_vec"}); m.MaxAge != time.Minute {
+		t.Errorf("max age of a summary = %v, want 1m", m.MaxAge)
+	}
+	if m := defaults.apply(&Metric{Type: "summary", MaxAge: time.Hour}); m.MaxAge != time.Hour {
+		t.Errorf("max age of a summary with its own = %v, want 1h", m.MaxAge)
+	}
+
+	latency := &Metric{ID: "latency", Name: "latency_seconds", Type: "summary", Objectives: map[float64]float64{0.5: 0.05}}
+	p := NewWithConfig(Config{Subsystem: "maxage", SummaryMaxAge: 50 * time.Millisecond, MetricsList: []*Metric{latency}})
+	if latency.MaxAge != 0 {
+		t.Error("definition of the custom metric modified")
+	}
+	p.MetricsList[0].MetricCollector.(prometheus.Summary).Observe(1)
+	time.Sleep(100 * time.Millisecond)
+
+	m := findMetric(t, prometheus.DefaultGatherer, "maxage_latency_seconds", nil)
+	if q := m.GetSummary().GetQuantile(); len(q) != 1 || !math.IsNaN(q[0].GetValue()) {
+		t.Errorf("quantiles = %v, want the observation expired", q)
+	}
+}
+
+func TestTrackBodyWriteDuration(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "bodywrite", TrackBodyWriteDuration: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/stream", func(c *gin.Context) {
+		c.Writer.WriteHeaderNow()
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			c.Writer.WriteString("chunk")
+			c.Writer.Flush()
+		}
+	})
+	request(e, "GET", "/stream")
+
+	m := findMetric(t, prometheus.DefaultGatherer, "bodywrite_body_write_duration_seconds", prometheus.Labels{"url": "/stream"})
+	if m == nil || m.GetHistogram().GetSampleSum() < 0.015 {
+		t.Errorf("body write duration = %v, want at least 15ms", m)
+	}
+}
+
+func TestDualURLLabels(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "dualurl", DualURLLabels: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/users/:id", func(c *gin.Context) {})
+	for i := 0; i <= maxRawPaths; i++ {
+		request(e, "GET", "/users/"+strconv.Itoa(i))
+	}
+
+	if v := metricValue(t, "dualurl_requests_total", prometheus.Labels{"route": "/users/:id", "path": "/users/0"}); v != 1 {
+		t.Errorf("request count of /users/0 = %v, want 1", v)
+	}
+	if v := metricValue(t, "dualurl_requests_total", prometheus.Labels{"route": "/users/:id", "path": "other"}); v != 1 {
+		t.Errorf("request count past the raw path cap = %v, want 1", v)
+	}
+}
+
+func TestCustomLabelsOrder(t *testing.T) {
+	labels := prometheus.Labels{"zone": "a", "region": "eu", "cluster": "c1", "env": "prod"}
+	for i, subsystem := range []string{"customorder1", "customorder2"} {
+		p := NewWithConfig(Config{Subsystem: subsystem, CustomLabels: labels})
+		if got := strings.Join(p.metrics.cntArgs[len(reqCnt.Args):], ","); got != "cluster,env,region,zone" {
+			t.Errorf("instance %d: custom label args = %s, want them sorted", i, got)
+		}
+		e := gin.New()
+		p.Use(e)
+		e.GET("/x", func(c *gin.Context) {})
+		request(e, "GET", "/x")
+		if v := metricValue(t, subsystem+"_requests_total", labels); v != 1 {
+			t.Errorf("instance %d: request count = %v, want 1", i, v)
+		}
+	}
+}
+
+func TestPushToAdditionalURLs(t *testing.T) {
+	var received int32
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	p := NewWithConfig(Config{Subsystem: "multipush"})
+	p.Ppg.PushGatewayURL = failing.URL
+	p.Ppg.AdditionalURLs = []string{healthy.URL}
+	p.SetPushGatewayJob("batch")
+	p.Use(gin.New())
+	if err := p.PushNow(); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("error = %v, want the failing gateway reported", err)
+	}
+	if n := atomic.LoadInt32(&received); n != 2 {
+		t.Errorf("%d gateways received the push, want 2", n)
+	}
+	for gateway, result := range map[string]string{healthy.URL: "success", failing.URL: "failure"} {
+		if v := metricValue(t, "multipush_pushgateway_pushes_total", prometheus.Labels{"gateway": gateway, "result": result}); v != 1 {
+			t.Errorf("%s pushes to %s = %v, want 1", result, gateway, v)
+		}
+	}
+}
+
+func TestDashboardPath(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "dashboard", DashboardPath: "/dashboard"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/ok", func(c *gin.Context) {})
+	e.GET("/fail", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+	request(e, "GET", "/ok")
+	request(e, "GET", "/fail")
+	request(e, "GET", "/fail")
+
+	w := request(e, "GET", "/dashboard")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("content type = %s, want HTML", ct)
+	}
+	body := w.Body.String()
+	for _, row := range []string{"<tr><td>/fail</td><td>2</td><td>100.00%</td>", "<tr><td>/ok</td><td>1</td><td>0.00%</td>"} {
+		if !strings.Contains(body, row) {
+			t.Errorf("no row %s in the dashboard:\n%s", row, body)
+		}
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "dashboard_requests_total", prometheus.Labels{"url": "/dashboard"}); m != nil {
+		t.Error("dashboard requests counted")
+	}
+}
+
+func TestBucketQuantile(t *testing.T) {
+	buckets := map[float64]uint64{0.1: 50, 1: 100, math.Inf(1): 100}
+	for q, want := range map[float64]string{0.5: "100ms", 0.75: "550ms"} {
+		if got := bucketQuantile(buckets, q); got != want {
+			t.Errorf("quantile %v = %s, want %s", q, got, want)
+		}
+	}
+	if got := bucketQuantile(map[float64]uint64{}, 0.5); got != "-" {
+		t.Errorf("quantile without observations = %s, want -", got)
+	}
+}
+
+func TestMaxURLCardinality(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "budget", MaxURLCardinality: 2})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/users/:id", func(c *gin.Context) {})
+	for _, id := range []string{"1", "2", "3", "4", "1"} {
+		request(e, "GET", "/users/"+id)
+	}
+
+	if v := metricValue(t, "budget_cardinality_budget_exceeded", nil); v != 1 {
+		t.Errorf("budget exceeded gauge = %v, want 1", v)
+	}
+	if v := metricValue(t, "budget_requests_total", prometheus.Labels{"url": OverBudgetURLLabel}); v != 2 {
+		t.Errorf("over budget request count = %v, want 2", v)
+	}
+	if v := metricValue(t, "budget_requests_total", prometheus.Labels{"url": "/users/1"}); v != 2 {
+		t.Errorf("request count of /users/1 = %v, want 2", v)
+	}
+}
+
+func TestStaticRouteLabel(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/app.js", []byte("console.log(1)"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := NewWithConfig(Config{Subsystem: "static", StaticRouteLabel: "static"})
+	e := gin.New()
+	p.Use(e)
+	e.Static("/assets", dir)
+	request(e, "GET", "/assets/app.js")
+
+	if v := metricValue(t, "static_requests_total", prometheus.Labels{"url": "static", "handler": "static"}); v != 1 {
+		t.Errorf("request count of static files = %v, want 1", v)
+	}
+}
+
+func TestSampleSuccessRate(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "sampled", SampleSuccesses: true, SampleSuccessRate: 0})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/ok", func(c *gin.Context) {})
+	e.GET("/fail", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+	request(e, "GET", "/ok")
+	request(e, "GET", "/fail")
+
+	if m := findMetric(t, prometheus.DefaultGatherer, "sampled_request_duration_seconds", prometheus.Labels{"url": "/ok"}); m != nil {
+		t.Error("sampled out 200 duration observed")
+	}
+	if v := metricValue(t, "sampled_request_duration_seconds", prometheus.Labels{"url": "/fail"}); v != 1 {
+		t.Errorf("500 duration observations = %v, want 1", v)
+	}
+	if v := metricValue(t, "sampled_requests_total", prometheus.Labels{"url": "/ok"}); v != 1 {
+		t.Errorf("request count of /ok = %v, want 1", v)
+	}
+}
+
+func TestNewProductionDefaults(t *testing.T) {
+	p := NewProductionDefaults("production")
+	if p.config.PathSource != FullPath {
+		t.Errorf("path source = %v, want route templates", p.config.PathSource)
+	}
+	if got := strings.Join(p.config.IgnorePaths, ","); got != "/healthz,/readyz" {
+		t.Errorf("ignored paths = %s, want the probes", got)
+	}
+	if p.config.MaxURLCardinality == 0 {
+		t.Error("url cardinality not bounded")
+	}
+
+	e := gin.New()
+	p.Use(e)
+	e.GET("/users/:id", func(c *gin.Context) {})
+	e.GET("/healthz", func(c *gin.Context) {})
+	request(e, "GET", "/users/1")
+	request(e, "GET", "/healthz")
+	if v := metricValue(t, "production_requests_total", prometheus.Labels{"url": "/users/:id"}); v != 1 {
+		t.Errorf("request count of /users/:id = %v, want 1", v)
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "production_requests_total", prometheus.Labels{"url": "/healthz"}); m != nil {
+		t.Error("probe counted")
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "marshal"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+
+	payload, err := p.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(payload), `marshal_requests_total{code="200"`) {
+		t.Errorf("payload without the request count:\n%s", payload)
+	}
+}
+
+func TestContextValueGauge(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem:         "contextgauge",
+		ContextValueGauge: ContextValueGauge{Key: "cache_entries", MetricName: "cache_entries"},
+	})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/set", func(c *gin.Context) { c.Set("cache_entries", 42) })
+	e.GET("/wrong", func(c *gin.Context) { c.Set("cache_entries", "many") })
+	request(e, "GET", "/set")
+	request(e, "GET", "/wrong")
+
+	if v := metricValue(t, "contextgauge_cache_entries", nil); v != 42 {
+		t.Errorf("gauge = %v, want 42", v)
+	}
+
+	if _, err := NewWithConfigE(Config{Subsystem: "contextgaugeinvalid", ContextValueGauge: ContextValueGauge{Key: "k", MetricName: "cache-entries"}}); err == nil {
+		t.Error("invalid gauge name accepted")
+	}
+}
+
+func TestTimeStage(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "stages", EnableStageTiming: true})
+	e := gin.New()
+	e.Use(p.TimeStage("auth", func(c *gin.Context) {}))
+	e.GET("/x", p.TimeStage("handler", func(c *gin.Context) {}))
+	request(e, "GET", "/x")
+
+	for _, stage := range []string{"auth", "handler"} {
+		if v := metricValue(t, "stages_middleware_stage_duration_seconds", prometheus.Labels{"stage": stage}); v != 1 {
+			t.Errorf("observations of stage %s = %v, want 1", stage, v)
+		}
+	}
+}
+
+func TestTrustForwardedHeaders(t *testing.T) {
+	for subsystem, want := range map[string]string{"forwarded_trusted": "public.example.com", "forwarded_untrusted": "internal:8080"} {
+		p := NewWithConfig(Config{Subsystem: subsystem, TrustForwardedHeaders: subsystem == "forwarded_trusted"})
+		e := gin.New()
+		p.Use(e)
+		e.GET("/x", func(c *gin.Context) {})
+		req := httptest.NewRequest("GET", "http://internal:8080/x", nil)
+		req.Header.Set("X-Forwarded-Host", "public.example.com, proxy.example.com")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		if v := metricValue(t, subsystem+"_requests_total", prometheus.Labels{"host": want}); v != 1 {
+			t.Errorf("%s: request count of host %s = %v, want 1", subsystem, want, v)
+		}
+	}
+}
+
+func TestReuseExistingCollectors(t *testing.T) {
+	existing := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "reuse",
+		Name:      reqCnt.Name,
+		Help:      reqCnt.Description,
+	}, reqCnt.Args)
+	prometheus.MustRegister(existing)
+
+	p, err := NewWithConfigE(Config{Subsystem: "reuse", ReuseExistingCollectors: true, FailFast: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+
+	// the collector of the application, gathered alone, has the series of the middleware
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(existing)
+	if m := findMetric(t, reg, "reuse_requests_total", prometheus.Labels{"url": "/x"}); m.GetCounter().GetValue() != 1 {
+		t.Errorf("request count of /x in the existing collector = %v, want 1", m.GetCounter().GetValue())
+	}
+
+	prometheus.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "reusemismatch",
+		Name:      reqSz.Name,
+		Help:      reqSz.Description,
+	}))
+	if _, err := NewWithConfigE(Config{Subsystem: "reusemismatch", ReuseExistingCollectors: true, FailFast: true}); err == nil {
+		t.Error("collector of another type adopted")
+	}
+
+	prometheus.MustRegister(prometheus.NewSummary(prometheus.SummaryOpts{
+		Subsystem: "reusehelp",
+		Name:      reqSz.Name,
+		Help:      "Another help.",
+	}))
+	if _, err := NewWithConfigE(Config{Subsystem: "reusehelp", ReuseExistingCollectors: true, FailFast: true}); err == nil || !strings.Contains(err.Error(), "no collector to reuse") {
+		t.Errorf("error = %v, want no collector to reuse", err)
+	}
+
+	// the adopted collectors stay registered
+	stillRegistered := func() bool {
+		err := prometheus.Register(existing)
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		return ok && are.ExistingCollector == existing
+	}
+	if err := p.Reconfigure(Config{Subsystem: "reuse_b"}); err != nil {
+		t.Fatal(err)
+	}
+	if !stillRegistered() {
+		t.Error("adopted collector unregistered by Reconfigure")
+	}
+	if _, err := NewWithConfigE(Config{Subsystem: "reuse", Subsystems: []string{"reusemismatch"}, ReuseExistingCollectors: true, FailFast: true}); err == nil {
+		t.Fatal("collector of another type adopted")
+	}
+	if !stillRegistered() {
+		t.Error("adopted collector unregistered on error")
+	}
+}
+
+func TestSetMetricsPathWithMiddleware(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "metricsauth"})
+	e := gin.New()
+	e.Use(p.HandlerFunc())
+	p.SetMetricsPathWithMiddleware(e, func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "Bearer secret" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+		}
+	})
+
+	if w := request(e, "GET", "/metrics"); w.Code != http.StatusUnauthorized {
+		t.Errorf("status without token = %d, want 401", w.Code)
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("status with token = %d, want 200", w.Code)
+	}
+}
+
+func TestNegativeDurationWarning(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	p := NewWithConfig(Config{Subsystem: "clampwarning", ExcludeBodyReadFromDuration: true})
+	e := gin.New()
+	p.Use(e)
+	e.POST("/x", overlappingReads)
+	for i := 0; i < 3; i++ {
+		body := slowReader{Reader: strings.NewReader("payload"), delay: 50 * time.Millisecond}
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/x", body))
+	}
+
+	warnings := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && strings.HasPrefix(entry.Message, "Clamping negative request duration") {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("clamping logged %d times, want once", warnings)
+	}
+}
+
+func TestNoBodyResponseSize(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "nobody"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	request(e, "GET", "/x")
+
+	m := findMetric(t, prometheus.DefaultGatherer, "nobody_response_size_bytes", nil)
+	if m == nil || m.GetSummary().GetSampleCount() != 1 || m.GetSummary().GetSampleSum() != 0 {
+		t.Errorf("response size = %v, want a single 0 observation", m)
+	}
+}
+
+func TestSetListenAddressWithMode(t *testing.T) {
+	defer func(w io.Writer) { gin.DefaultWriter = w }(gin.DefaultWriter)
+	for useDefault, logged := range map[bool]bool{false: false, true: true} {
+		var buf bytes.Buffer
+		gin.DefaultWriter = &buf
+		p := NewWithConfig(Config{Subsystem: fmt.Sprintf("listenmode_%t", useDefault)})
+		p.SetListenAddressWithMode("127.0.0.1:0", useDefault)
+		p.router.GET(p.MetricsPath, p.prometheusHandler())
+		request(p.router, "GET", p.MetricsPath)
+
+		if got := strings.Contains(buf.String(), p.MetricsPath); got != logged {
+			t.Errorf("scrape logged with useDefault %t: %t, want %t", useDefault, got, logged)
+		}
+	}
+}
+
+func TestCacheHitContextKey(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "cachehit", CacheHitContextKey: "cache_hit"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/cached", func(c *gin.Context) { c.Set("cache_hit", true) })
+	e.GET("/uncached", func(c *gin.Context) {})
+	request(e, "GET", "/cached")
+	request(e, "GET", "/uncached")
+
+	for url, cache := range map[string]string{"/cached": "hit", "/uncached": "miss"} {
+		if v := metricValue(t, "cachehit_requests_total", prometheus.Labels{"url": url, "cache": cache}); v != 1 {
+			t.Errorf("request count of %s with cache %s = %v, want 1", url, cache, v)
+		}
+	}
+}
+
+func TestCustomLabelScope(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem:        "labelscope",
+		CustomLabels:     map[string]string{"region": "eu", "tenant": "acme"},
+		CustomLabelScope: map[string][]string{"region": {"reqCnt", "reqDur"}},
+	})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+
+	if v := metricValue(t, "labelscope_requests_total", prometheus.Labels{"region": "eu", "tenant": "acme"}); v != 1 {
+		t.Errorf("request count = %v, want 1 with both custom labels", v)
+	}
+	m := findMetric(t, prometheus.DefaultGatherer, "labelscope_request_duration_seconds", prometheus.Labels{"region": "eu"})
+	if m == nil {
+		t.Fatal("duration without the region label")
+	}
+	if hasLabels(m, prometheus.Labels{"tenant": "acme"}) {
+		t.Error("tenant label not scoped to the request count")
+	}
+
+	if _, err := NewWithConfigE(Config{Subsystem: "labelscopeinvalid", CustomLabels: map[string]string{"region": "eu"}, CustomLabelScope: map[string][]string{"region": {"resSz"}}}); err == nil {
+		t.Error("custom label scoped to an unlabeled metric")
+	}
+}
+
+// slowClientWriter is a http.ResponseWriter whose writes block as for a slow downloading client
+type slowClientWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (w slowClientWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.Write(b)
+}
+
+func (w slowClientWriter) WriteString(s string) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.WriteString(s)
+}
+
+func TestExcludeClientWriteTime(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "clientwrite", ExcludeClientWriteTime: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {
+		c.String(http.StatusOK, "first")
+		c.Writer.WriteString("second")
+	})
+	e.ServeHTTP(slowClientWriter{httptest.NewRecorder(), 50 * time.Millisecond}, httptest.NewRequest("GET", "/x", nil))
+
+	m := findMetric(t, prometheus.DefaultGatherer, "clientwrite_request_duration_seconds", nil)
+	if m == nil || m.GetHistogram().GetSampleSum() >= 0.05 {
+		t.Errorf("duration = %v, want less than the 100ms blocked on the client", m)
+	}
+}
+
+func TestPushGatewayMethod(t *testing.T) {
+	var method string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+	}))
+	defer gateway.Close()
+
+	p := NewWithConfig(Config{Subsystem: "pushmethod"})
+	p.Ppg.PushGatewayURL = gateway.URL
+	p.SetPushGatewayJob("batch")
+	p.Use(gin.New())
+	for _, want := range []string{"", http.MethodPut} {
+		p.Ppg.Method = want
+		if err := p.PushNow(); err != nil {
+			t.Fatal(err)
+		}
+		if want == "" {
+			want = http.MethodPost
+		}
+		if method != want {
+			t.Errorf("push method = %s, want %s", method, want)
+		}
+	}
+
+	p.Ppg.Method = http.MethodPatch
+	if err := p.PushNow(); err == nil {
+		t.Error("invalid push method accepted")
+	}
+}
+
+// errReader fails every read
+type errReader struct{}
+
+func (errReader) Read(b []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestTrackBodyReadErrors(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "bodyreaderrors", TrackBodyReadErrors: true})
+	e := gin.New()
+	p.Use(e)
+	e.POST("/upload", func(c *gin.Context) { ioutil.ReadAll(c.Request.Body) })
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", errReader{}))
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("ok")))
+
+	if v := metricValue(t, "bodyreaderrors_request_body_read_errors_total", prometheus.Labels{"url": "/upload"}); v != 1 {
+		t.Errorf("body read error count = %v, want 1", v)
+	}
+}
+
+func TestReqCntURLLabelMappingFnWithStatus(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem:  "urlbystatus",
+		PathSource: FullPath,
+		ReqCntURLLabelMappingFnWithStatus: func(c *gin.Context, status int) string {
+			if status == http.StatusNotFound {
+				return "<notfound>"
+			}
+			return c.FullPath()
+		},
+	})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/users/:id", func(c *gin.Context) {})
+	request(e, "GET", "/users/1")
+	request(e, "GET", "/missing/1")
+	request(e, "GET", "/missing/2")
+
+	for url, want := range map[string]float64{"/users/:id": 1, "<notfound>": 2} {
+		if v := metricValue(t, "urlbystatus_requests_total", prometheus.Labels{"url": url}); v != want {
+			t.Errorf("request count of %s = %v, want %v", url, v, want)
+		}
+	}
+}
+
+// brokenCollector is a collector failing to collect
+type brokenCollector struct{}
+
+var brokenDesc = prometheus.NewDesc("broken", "A collector failing to collect.", nil, nil)
+
+func (brokenCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- brokenDesc
+}
+
+func (brokenCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.NewInvalidMetric(brokenDesc, errors.New("inconsistent collector"))
+}
+
+func TestSelfCheckInterval(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "selfcheck", SelfCheckInterval: 5 * time.Millisecond})
+	defer p.StopSelfCheck()
+	broken := brokenCollector{}
+	prometheus.MustRegister(broken)
+	defer prometheus.Unregister(broken)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		var m dto.Metric
+		p.metrics.gatherErrors.Write(&m)
+		if m.GetCounter().GetValue() > 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("gather errors not counted")
+}
+
+func TestHeadUsesContentLength(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "headsize", HeadUsesContentLength: true})
+	e := gin.New()
+	p.Use(e)
+	e.HEAD("/file", func(c *gin.Context) {
+		c.Header("Content-Length", "1000")
+		c.Status(http.StatusOK)
+	})
+	request(e, "HEAD", "/file")
+
+	m := findMetric(t, prometheus.DefaultGatherer, "headsize_response_size_bytes", nil)
+	if m == nil || m.GetSummary().GetSampleSum() != 1000 {
+		t.Errorf("response size = %v, want 1000", m)
+	}
+}
+
+func TestSynchronousPush(t *testing.T) {
+	var pushes int32
+	var body []byte
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pushes, 1)
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer gateway.Close()
+
+	p := NewWithConfig(Config{Subsystem: "syncpush"})
+	p.Ppg.Synchronous = true
+	p.SetPushGateway(gateway.URL, "", 1)
+	if p.pushStop != nil {
+		t.Error("push ticker started")
+	}
+	p.Use(gin.New())
+	if err := p.PushNow(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&pushes); n != 1 {
+		t.Errorf("%d pushes, want 1", n)
+	}
+	if !strings.Contains(string(body), "syncpush_request_size_bytes") {
+		t.Errorf("pushed metrics without those of the instance:\n%s", body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.PushLoop(ctx); err != context.Canceled {
+		t.Errorf("push loop error = %v, want the cancellation", err)
+	}
+	p.Ppg.PushIntervalSeconds = 0
+	if err := p.PushLoop(context.Background()); err == nil {
+		t.Error("push loop started without interval")
+	}
+}
+
+func TestDynamicLabels(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem:     "dynamiclabels",
+		CustomLabels:  map[string]string{"region": "eu", "zone": "a"},
+		DynamicLabels: map[string]string{"tenant": "tenantID"},
+	})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {
+		if tenant := c.Query("tenant"); tenant != "" {
+			c.Set("tenantID", tenant)
+		}
+	})
+	request(e, "GET", "/x?tenant=acme")
+	request(e, "GET", "/x")
+
+	for tenant, want := range map[string]float64{"acme": 1, "": 1} {
+		labels := prometheus.Labels{"region": "eu", "zone": "a", "tenant": tenant}
+		if v := metricValue(t, "dynamiclabels_requests_total", labels); v != want {
+			t.Errorf("request count of tenant %q = %v, want %v", tenant, v, want)
+		}
+	}
+
+	if _, err := NewWithConfigE(Config{
+		Subsystem:     "dynamiclabelsclash",
+		CustomLabels:  map[string]string{"tenant": "acme"},
+		DynamicLabels: map[string]string{"tenant": "tenantID"},
+	}); err == nil {
+		t.Error("label both custom and dynamic accepted")
+	}
+	for _, cfg := range []Config{
+		{Subsystem: "customlabelurl", CustomLabels: map[string]string{"url": "x"}},
+		{Subsystem: "dynamiclabelcode", DynamicLabels: map[string]string{"code": "status"}},
+		{Subsystem: "dynamiclabelrole", DynamicLabels: map[string]string{"role": "role"}, RoleFn: func(c *gin.Context) string { return "" }},
+		{Subsystem: "customlabelcache", CustomLabels: map[string]string{"cache": "x"}, CacheHitContextKey: "cached"},
+		{Subsystem: "customlabelmethod", CustomLabels: map[string]string{"method": "x"}, CustomLabelScope: map[string][]string{"method": {"reqDur"}}},
+	} {
+		if _, err := NewWithConfigE(cfg); err == nil {
+			t.Errorf("custom labels clashing with a standard label accepted: %v %v", cfg.CustomLabels, cfg.DynamicLabels)
+		}
+	}
+}
+
+func TestLegacyWithConfig(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p := NewPrometheus("legacy").
+		WithConfig(func(cfg *Config) { cfg.TrackRateLimited = true }).
+		WithRuntimeCollectors(reg)
+	e := gin.New()
+	p.Use(e)
+	e.GET("/limited", func(c *gin.Context) {
+		p.MarkRateLimited(c)
+		c.AbortWithStatus(http.StatusTooManyRequests)
+	})
+	request(e, "GET", "/limited")
+
+	if v := metricValue(t, "legacy_requests_rate_limited_total", prometheus.Labels{"url": "/limited"}); v != 1 {
+		t.Errorf("rate limited count = %v, want 1", v)
+	}
+	for _, name := range []string{"go_goroutines", "process_start_time_seconds"} {
+		if m := findMetric(t, reg, name, nil); m == nil {
+			t.Errorf("no %s in the registry", name)
+		}
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "environment", Environment: "staging"})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+
+	for _, name := range []string{"environment_requests_total", "environment_request_size_bytes"} {
+		if m := findMetric(t, prometheus.DefaultGatherer, name, prometheus.Labels{"env": "staging"}); m == nil {
+			t.Errorf("no %s series with env=\"staging\"", name)
+		}
+	}
+}
+
+func TestDurationByHandler(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "byhandler", DurationByHandler: true})
+	e := gin.New()
+	p.Use(e)
+	shared := func(c *gin.Context) {}
+	e.GET("/a", shared)
+	e.GET("/b", shared)
+	request(e, "GET", "/a")
+	request(e, "GET", "/b")
+
+	m := findMetric(t, prometheus.DefaultGatherer, "byhandler_request_duration_seconds", nil)
+	if m == nil || m.GetHistogram().GetSampleCount() != 2 {
+		t.Errorf("duration = %v, want both routes in one series", m)
+	}
+	if hasLabels(m, prometheus.Labels{"url": "/a"}) {
+		t.Error("duration still labeled by url")
+	}
+}
+
+func TestTrackMaxHeaderSize(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "maxheader", TrackMaxHeaderSize: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.Header.Set("X-Small", "a")
+	req.Header.Set("X-Large", strings.Repeat("a", 2048))
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	m := findMetric(t, prometheus.DefaultGatherer, "maxheader_max_request_header_bytes", nil)
+	if m == nil || m.GetHistogram().GetSampleSum() != 2048 {
+		t.Errorf("largest header = %v, want 2048", m)
+	}
+}
+
+func TestPushNowWithResult(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	p := NewWithConfig(Config{Subsystem: "pushresult"})
+	p.Ppg.PushGatewayURL = healthy.URL
+	p.Ppg.AdditionalURLs = []string{failing.URL}
+	p.SetPushGatewayJob("batch")
+	p.Use(gin.New())
+	results, err := p.PushNowWithResult()
+	if err == nil {
+		t.Error("no error with a failing gateway")
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results, want 2", len(results))
+	}
+
+	ok, failed := results[0], results[1]
+	if ok.GatewayURL != healthy.URL || ok.StatusCode != http.StatusOK || ok.BytesSent == 0 || ok.Duration <= 0 || ok.Err != nil {
+		t.Errorf("result of the healthy gateway = %+v", ok)
+	}
+	if failed.GatewayURL != failing.URL || failed.StatusCode != http.StatusBadGateway || failed.Err == nil {
+		t.Errorf("result of the failing gateway = %+v", failed)
+	}
+}
+
+func TestExemplarResponseHeaders(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "responseexemplar", ExemplarResponseHeaders: []string{"X-Request-Id"}})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) { c.Header("X-Request-Id", "req-42") })
+	request(e, "GET", "/x")
+
+	m := findMetric(t, prometheus.DefaultGatherer, "responseexemplar_request_duration_seconds", nil)
+	if got := exemplarLabels(m); len(got) != 1 || got[0] != "x_request_id=req-42" {
+		t.Errorf("exemplars = %v, want the request id", got)
+	}
+
+	if _, err := NewWithConfigE(Config{Subsystem: "responseexemplarinvalid", ExemplarResponseHeaders: []string{"X.Id"}}); err == nil {
+		t.Error("header making an invalid label name accepted")
+	}
+}
+
+func TestLabelValueAllowlists(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "allowlists", LabelValueAllowlists: map[string][]string{"method": {"GET", "POST"}}})
+	e := gin.New()
+	p.Use(e)
+	e.Handle("PATCH", "/x", func(c *gin.Context) {})
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "PATCH", "/x")
+	request(e, "GET", "/x")
+
+	for method, want := range map[string]float64{OtherLabelValue: 1, "GET": 1} {
+		if v := metricValue(t, "allowlists_requests_total", prometheus.Labels{"method": method}); v != want {
+			t.Errorf("request count of method %s = %v, want %v", method, v, want)
+		}
+		if v := metricValue(t, "allowlists_request_duration_seconds", prometheus.Labels{"method": method}); v != want {
+			t.Errorf("duration observations of method %s = %v, want %v", method, v, want)
+		}
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "allowlists_requests_total", prometheus.Labels{"method": "PATCH"}); m != nil {
+		t.Error("method outside the allowlist recorded")
+	}
+}
+
+func TestTrack1xx(t *testing.T) {
+	p := NewWithConfig(Config{Subsystem: "informational", Track1xx: true})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/hints", func(c *gin.Context) {
+		c.Header("Link", "</style.css>; rel=preload")
+		c.Writer.WriteHeader(http.StatusEarlyHints)
+		c.Writer.WriteHeaderNow()
+		c.String(http.StatusOK, "ok")
+	})
+	e.GET("/unsent", func(c *gin.Context) {
+		// replaced before being sent
+		c.Writer.WriteHeader(http.StatusContinue)
+		c.String(http.StatusOK, "ok")
+	})
+	request(e, "GET", "/hints")
+	request(e, "GET", "/unsent")
+
+	if v := metricValue(t, "informational_requests_total", prometheus.Labels{"url": "/hints", "code": "200"}); v != 1 {
+		t.Errorf("request count with the final code = %v, want 1", v)
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "informational_requests_total", prometheus.Labels{"code": "103"}); m != nil {
+		t.Error("request counted with the informational code")
+	}
+	if v := metricValue(t, "informational_informational_responses_total", prometheus.Labels{"code": "103"}); v != 1 {
+		t.Errorf("early hints count = %v, want 1", v)
+	}
+	if v := metricValue(t, "informational_requests_total", prometheus.Labels{"url": "/unsent", "code": "200"}); v != 1 {
+		t.Errorf("request count of /unsent = %v, want 1", v)
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "informational_informational_responses_total", prometheus.Labels{"code": "100"}); m != nil {
+		t.Error("unsent 100 counted")
+	}
+}
+
+func TestResourceAttributes(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem:          "resource",
+		ResourceAttributes: map[string]string{"service.name": "checkout", "service.version": "1.2.0"},
+	})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	request(e, "GET", "/x")
+
+	labels := prometheus.Labels{"service_name": "checkout", "service_version": "1.2.0"}
+	if m := findMetric(t, prometheus.DefaultGatherer, "resource_requests_total", labels); m == nil {
+		t.Error("no request count with the resource labels")
+	}
+
+	if _, err := NewWithConfigE(Config{
+		Subsystem:          "resourceclash",
+		ResourceAttributes: map[string]string{"service.name": "a", "service-name": "b"},
+	}); err == nil {
+		t.Error("attributes normalized to the same label accepted")
+	}
+	for _, cfg := range []Config{
+		{Subsystem: "resourceurl", ResourceAttributes: map[string]string{"url": "a"}},
+		{Subsystem: "resourcecode", ResourceAttributes: map[string]string{"code": "a"}},
+		{Subsystem: "resourcele", ResourceAttributes: map[string]string{"le": "a"}},
+		{Subsystem: "resourcecustom", ResourceAttributes: map[string]string{"region": "a"}, CustomLabels: map[string]string{"region": "eu"}},
+		{Subsystem: "envlabel", Environment: "staging", DynamicLabels: map[string]string{"env": "env"}},
+		{Subsystem: "envmetric", Environment: "staging", MetricsList: []*Metric{{ID: "jobs", Name: "jobs_total", Description: "Jobs.", Type: "counter_vec", Args: []string{"env"}}}},
+	} {
+		if _, err := NewWithConfigE(cfg); err == nil {
+			t.Errorf("const labels clashing with a metric label accepted: %v %q", cfg.ResourceAttributes, cfg.Environment)
+		}
+	}
+}
+
+func TestSubsystemFn(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem:  "gateway",
+		Subsystems: []string{"internal", "external"},
+		SubsystemFn: func(c *gin.Context) string {
+			if c.GetHeader("X-Internal") != "" {
+				return "internal"
+			}
+			return "external"
+		},
+	})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/x", func(c *gin.Context) {})
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.Header.Set("X-Internal", "1")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	request(e, "GET", "/x")
+	request(e, "GET", "/x")
+
+	for subsystem, want := range map[string]float64{"internal": 1, "external": 2} {
+		if v := metricValue(t, subsystem+"_requests_total", prometheus.Labels{"url": "/x"}); v != want {
+			t.Errorf("request count of %s = %v, want %v", subsystem, v, want)
+		}
+	}
+	if m := findMetric(t, prometheus.DefaultGatherer, "gateway_requests_total", prometheus.Labels{"url": "/x"}); m != nil {
+		t.Error("classified requests recorded under the default subsystem")
+	}
+}
+
+func TestURLReplacements(t *testing.T) {
+	p := NewWithConfig(Config{
+		Subsystem: "replacements",
+		URLReplacements: []URLReplacement{
+			{Pattern: regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`), Replacement: ":id"},
+			{Pattern: regexp.MustCompile(`/[0-9]+(/|$)`), Replacement: "/:num$1"},
+		},
+	})
+	e := gin.New()
+	p.Use(e)
+	e.GET("/users/:id", func(c *gin.Context) {})
+	e.GET("/pages/:n", func(c *gin.Context) {})
+	request(e, "GET", "/users/123e4567-e89b-12d3-a456-426614174000")
+	request(e, "GET", "/users/00000000-0000-0000-0000-000000000000")
+	request(e, "GET", "/pages/7")
+
+	for url, want := range map[string]float64{"/users/:id": 2, "/pages/:num": 1} {
+		if v := metricValue(t, "replacements_requests_total", prometheus.Labels{"url": url}); v != want {
+			t.Errorf("request count of %s = %v, want %v", url, v, want)
+		}
+	}
+
+	if _, err := NewWithConfigE(Config{Subsystem: "replacementsinvalid", URLReplacements: []URLReplacement{{Replacement: ":id"}}}); err == nil {
+		t.Error("replacement without pattern accepted")
+	}
+}